@@ -3,20 +3,35 @@ package main
 import (
 	"context"
 	"net/http"
+	"sync"
 
 	"github.com/JacobNewton007/sendchamp-go-test/internal/data"
 )
 
 type contextKey string
 
-const userContextKey = contextKey("user")
+const (
+	userContextKey        = contextKey("user")
+	tokenContextKey       = contextKey("token")
+	userLoaderContextKey  = contextKey("userLoader")
+	requestIDContextKey   = contextKey("requestID")
+	requestInfoContextKey = contextKey("requestInfo")
+)
 
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
+	// Record the user for the access log.
+	if info, ok := r.Context().Value(requestInfoContextKey).(*requestInfo); ok && !user.IsAnonymous() {
+		info.userID = user.ID
+	}
+
 	ctx := context.WithValue(r.Context(), userContextKey, user)
 	return r.WithContext(ctx)
 
 }
 
+// The user returned by contextGetUser() is only guaranteed to have its ID set. When
+// requests are authenticated with stateless JWTs the full record isn't loaded up front,
+// so use contextLoadUser() whenever any other field is needed.
 func (app *application) contextGetUser(r *http.Request) *data.User {
 	user, ok := r.Context().Value(userContextKey).(*data.User)
 	if !ok {
@@ -25,3 +40,79 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 
 	return user
 }
+
+// The contextSetToken() method stores the plaintext bearer token that authenticated the
+// request, so that handlers like logout can act on the current session.
+func (app *application) contextSetToken(r *http.Request, token string) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// The contextGetToken() method returns the bearer token for the request, or the empty
+// string if the request was made anonymously.
+func (app *application) contextGetToken(r *http.Request) string {
+	token, _ := r.Context().Value(tokenContextKey).(string)
+	return token
+}
+
+func (app *application) contextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+// The contextGetRequestID() method returns the ID assigned to the request by the
+// requestID() middleware, or the empty string if it doesn't have one.
+func (app *application) contextGetRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
+
+// requestInfo collects details for the access log which only become known further down
+// the middleware chain. Middleware can't change the context seen by the middleware
+// wrapping it, so logRequest() stores a pointer which the later code fills in.
+type requestInfo struct {
+	userID int64
+	route  string
+}
+
+func (app *application) contextSetRequestInfo(r *http.Request, info *requestInfo) *http.Request {
+	ctx := context.WithValue(r.Context(), requestInfoContextKey, info)
+	return r.WithContext(ctx)
+}
+
+// userLoader fetches the full user record for a request at most once.
+type userLoader struct {
+	once sync.Once
+	load func() (*data.User, error)
+	user *data.User
+	err  error
+}
+
+// The contextSetUserLoader() method stores a function which loads the full user record
+// on demand. It's used by the JWT authentication mode, where only the user ID is known
+// after verifying the token.
+func (app *application) contextSetUserLoader(r *http.Request, load func() (*data.User, error)) *http.Request {
+	ctx := context.WithValue(r.Context(), userLoaderContextKey, &userLoader{load: load})
+	return r.WithContext(ctx)
+}
+
+// The contextLoadUser() method returns the full user record for the request, loading
+// it from the database the first time it's called if necessary.
+func (app *application) contextLoadUser(r *http.Request) (*data.User, error) {
+	loader, ok := r.Context().Value(userLoaderContextKey).(*userLoader)
+	if !ok {
+		return app.contextGetUser(r), nil
+	}
+
+	loader.once.Do(func() {
+		loader.user, loader.err = loader.load()
+	})
+
+	return loader.user, loader.err
+}
+
+// The modelsFor() method returns the models wrapped so that every database call made
+// while handling the request is recorded as a span in the request's trace.
+func (app *application) modelsFor(r *http.Request) data.Models {
+	return app.models.Traced(r.Context())
+}
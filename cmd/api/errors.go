@@ -3,17 +3,69 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strconv"
+
+	"github.com/JacobNewton007/sendchamp-go-test/internal/jsonlog"
+)
+
+// Define the machine-readable error codes which are sent in the "code" field of error
+// responses. Unlike the messages, these are part of the API contract: clients can
+// rely on them, so existing codes must never be renamed.
+const (
+	codeServerError            = "server_error"
+	codeNotFound               = "not_found"
+	codeMethodNotAllowed       = "method_not_allowed"
+	codeBadRequest             = "bad_request"
+	codeValidationFailed       = "validation_failed"
+	codeEditConflict           = "edit_conflict"
+	codeRateLimited            = "rate_limited"
+	codeInvalidCredentials     = "invalid_credentials"
+	codeInvalidToken           = "invalid_token"
+	codeInvalidRefreshToken    = "invalid_refresh_token"
+	codeAuthenticationRequired = "authentication_required"
+	codeNotPermitted           = "not_permitted"
+	codeInactiveAccount        = "inactive_account"
+	codeServiceUnavailable     = "service_unavailable"
 )
 
+// apiError is the value of the "error" key in every error response. The message is
+// meant for humans and may change, so clients should switch on the code instead.
+// Details holds per-field messages when a request fails validation.
+type apiError struct {
+	Code      string            `json:"code"`
+	Message   string            `json:"message"`
+	Details   map[string]string `json:"details,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+}
+
 func (app *application) logError(r *http.Request, err error) {
-	app.logger.PrintError(err, map[string]string{
+	app.requestLogger(r).PrintError(err, jsonlog.Fields{
 		"request_method": r.Method,
 		"request_url":    r.URL.String(),
 	})
 }
 
-func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message interface{}) {
-	env := envelope{"error": message}
+// The requestLogger() helper returns a child logger which adds the request ID to every
+// entry, so that everything logged while serving a request can be tied together.
+func (app *application) requestLogger(r *http.Request) *jsonlog.Logger {
+	id := app.contextGetRequestID(r)
+	if id == "" {
+		return app.logger
+	}
+
+	return app.logger.With(jsonlog.Fields{"request_id": id})
+}
+
+// The errorResponse() method is a generic helper for sending JSON-formatted error
+// messages to the client with a given status code and error code. All the helpers
+// below go through it, so that every error has the same shape.
+func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, code, message string, details map[string]string) {
+	env := envelope{"error": apiError{
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		RequestID: app.contextGetRequestID(r),
+	}}
 
 	err := app.writeJSON(w, status, env, nil)
 	if err != nil {
@@ -26,57 +78,79 @@ func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Reque
 	app.logError(r, err)
 
 	message := "the server encoutered a problem and could not process your request"
-	app.errorResponse(w, r, http.StatusInternalServerError, message)
+	app.errorResponse(w, r, http.StatusInternalServerError, codeServerError, message, nil)
 }
 
 func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
 	message := "the requested resource could not be found"
-	app.errorResponse(w, r, http.StatusNotFound, message)
+	app.errorResponse(w, r, http.StatusNotFound, codeNotFound, message, nil)
 }
 
 func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
 	message := fmt.Sprintf("the %s method is not supported fot this resource", r.Method)
-	app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
+	app.errorResponse(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, message, nil)
 }
 
 func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Request, err error) {
-	app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+	app.errorResponse(w, r, http.StatusBadRequest, codeBadRequest, err.Error(), nil)
 }
 
 // Note that the errors parameter here has the type map[string]string, which is exactly
-// the same as the errors map contained in our Validator type.
+// the same as the errors map contained in our Validator type. It's sent as the details
+// of the error, keyed by field name.
 func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
-	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
+	message := "the request contains invalid fields"
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, codeValidationFailed, message, errors)
 }
 
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
 	message := "unable to update the record due to an edit conflict, please try again"
-	app.errorResponse(w, r, http.StatusConflict, message)
+	app.errorResponse(w, r, http.StatusConflict, codeEditConflict, message, nil)
 }
 
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
 	message := "rate limit exceeded"
-	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+	app.errorResponse(w, r, http.StatusTooManyRequests, codeRateLimited, message, nil)
 }
 
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authentication credentials"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, codeInvalidCredentials, message, nil)
 }
 
 func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("WWW-Authenticate", "Bearer")
 
 	message := "invalid or missing authenticate token"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, codeInvalidToken, message, nil)
+}
+
+func (app *application) invalidRefreshTokenResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid, expired or already used refresh token"
+	app.errorResponse(w, r, http.StatusUnauthorized, codeInvalidRefreshToken, message, nil)
 }
 
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
 	message := "you must be authenticated to access this resource"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, codeAuthenticationRequired, message, nil)
+}
+
+func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account doesn't have the necessary permissions to access this resource"
+	app.errorResponse(w, r, http.StatusForbidden, codeNotPermitted, message, nil)
 }
 
 func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account must be activated to access this resource"
-	app.errorResponse(w, r, http.StatusForbidden, message)
+	app.errorResponse(w, r, http.StatusForbidden, codeInactiveAccount, message, nil)
+}
+
+// The serviceUnavailableResponse() method is used when a request can't be handled
+// because something we depend on is struggling. The Retry-After header tells the
+// client how many seconds to wait before trying again.
+func (app *application) serviceUnavailableResponse(w http.ResponseWriter, r *http.Request, retryAfter int) {
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+
+	message := "the server is temporarily unable to handle your request, please try again later"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, codeServiceUnavailable, message, nil)
 }
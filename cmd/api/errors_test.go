@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestErrorEnvelope(t *testing.T) {
+	ts := newTestServer(t)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       interface{}
+		wantStatus int
+		wantCode   string
+		wantField  string
+	}{
+		{"not found", http.MethodGet, "/v1/nothing-here", nil, http.StatusNotFound, codeNotFound, ""},
+		{"method not allowed", http.MethodPut, "/v1/tasks", nil, http.StatusMethodNotAllowed, codeMethodNotAllowed, ""},
+		{"bad request", http.MethodPost, "/v1/users", map[string]string{"unknown": "field"}, http.StatusBadRequest, codeBadRequest, ""},
+		{"validation failed", http.MethodPost, "/v1/users", map[string]string{"name": "Alice", "email": "not-an-email", "password": "pa55word1234"}, http.StatusUnprocessableEntity, codeValidationFailed, "email"},
+		{"invalid credentials", http.MethodPost, "/v1/tokens/authentication", map[string]string{"email": "nobody@example.com", "password": "pa55word1234"}, http.StatusUnauthorized, codeInvalidCredentials, ""},
+		{"health check with wrong method", http.MethodDelete, "/healthz", nil, http.StatusNotFound, codeNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(tt.method, tt.path, "", tt.body)
+
+			if res.status != tt.wantStatus {
+				t.Errorf("got status %d, want %d", res.status, tt.wantStatus)
+			}
+
+			apiErr, ok := res.body["error"].(map[string]interface{})
+			if !ok || len(res.body) != 1 {
+				t.Fatalf("body %v isn't an error envelope", res.body)
+			}
+
+			if apiErr["code"] != tt.wantCode {
+				t.Errorf("got code %v, want %q", apiErr["code"], tt.wantCode)
+			}
+			if message, _ := apiErr["message"].(string); message == "" {
+				t.Error("error has no message")
+			}
+
+			// The request ID in the body is the one in the response header, so that a
+			// client reporting an error can be matched up with the logs.
+			if id := res.header.Get("X-Request-ID"); id == "" || apiErr["request_id"] != id {
+				t.Errorf("got request_id %v, X-Request-ID header %q", apiErr["request_id"], id)
+			}
+
+			details, _ := apiErr["details"].(map[string]interface{})
+			switch {
+			case tt.wantField == "" && apiErr["details"] != nil:
+				t.Errorf("got details %v, want none", apiErr["details"])
+			case tt.wantField != "" && details[tt.wantField] == nil:
+				t.Errorf("got details %v, want a message for %q", apiErr["details"], tt.wantField)
+			}
+		})
+	}
+}
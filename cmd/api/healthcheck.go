@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/JacobNewton007/sendchamp-go-test/internal/jsonlog"
+)
+
+// The systemInfo() helper returns the details about the running build which are
+// included in the health check responses.
+func (app *application) systemInfo() map[string]string {
+	return map[string]string{
+		"environment": app.config.env,
+		"version":     version,
+		"build_time":  buildTime,
+	}
+}
+
+// The livenessHandler() serves /healthz. It only shows that the process is up and able
+// to serve requests, so it never checks our dependencies: restarting the API wouldn't
+// fix a database outage.
+func (app *application) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	env := envelope{
+		"status":      "available",
+		"system_info": app.systemInfo(),
+	}
+
+	err := app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readinessHandler() serves /readyz, which tells load balancers whether to send us
+// traffic. It fails with a 503 Service Unavailable response once the server has started
+// shutting down, or if the database can't be reached. The state of the RabbitMQ
+// connection is reported too, but doesn't make us unready: new tasks wait in the
+// outbox until the connection is back, so the API keeps working without it.
+func (app *application) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{}
+	ready := true
+
+	if atomic.LoadInt32(&app.shuttingDown) == 1 {
+		checks["server"] = "shutting down"
+		ready = false
+	} else {
+		checks["server"] = "ok"
+	}
+
+	// The in-memory backend has no database to check.
+	if app.db != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+		defer cancel()
+
+		err := app.db.PingContext(ctx)
+		if err != nil {
+			// Don't send the error itself to the client, as it may include
+			// connection details.
+			app.requestLogger(r).PrintWarn("readiness check failed", jsonlog.Fields{
+				"check": "database",
+				"error": err,
+			})
+			checks["database"] = "unavailable"
+			ready = false
+		} else {
+			checks["database"] = "ok"
+		}
+	}
+
+	switch {
+	case app.inProcessQueue:
+		checks["rabbitmq"] = "not used"
+	case app.rMq.IsClosed():
+		checks["rabbitmq"] = "unavailable"
+	default:
+		checks["rabbitmq"] = "ok"
+	}
+
+	status := http.StatusOK
+	env := envelope{
+		"status":      "available",
+		"system_info": app.systemInfo(),
+		"checks":      checks,
+	}
+
+	if !ready {
+		status = http.StatusServiceUnavailable
+		env["status"] = "unavailable"
+	}
+
+	err := app.writeJSON(w, status, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReadiness(t *testing.T) {
+	ts := newTestServer(t)
+
+	// The test server has no RabbitMQ connection. That's reported, but the API can
+	// still take requests, as new tasks wait in the outbox.
+	res := ts.do(http.MethodGet, "/readyz", "", nil)
+	checks, _ := res.body["checks"].(map[string]interface{})
+	if res.status != http.StatusOK || checks["rabbitmq"] != "unavailable" {
+		t.Errorf("without RabbitMQ: got status %d, body %v", res.status, res.body)
+	}
+
+	atomic.StoreInt32(&ts.app.shuttingDown, 1)
+
+	res = ts.do(http.MethodGet, "/readyz", "", nil)
+	checks, _ = res.body["checks"].(map[string]interface{})
+	if res.status != http.StatusServiceUnavailable || checks["server"] != "shutting down" {
+		t.Errorf("shutting down: got status %d, body %v", res.status, res.body)
+	}
+}
@@ -6,11 +6,14 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	// "net/url"
+	"net/url"
 	"strconv"
+	"time"
+
 	// "strings"
 
-	// "github.com/JacobNewton007/sendchamp-go-test/internal/validator"
+	"github.com/JacobNewton007/sendchamp-go-test/internal/jsonlog"
+	"github.com/JacobNewton007/sendchamp-go-test/internal/validator"
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -92,20 +95,20 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 	return nil
 }
 
-// func (app *application) readString(qs url.Values, key string, defaultValue string) string {
-// 	// Extract the value for a given key from the query string.
-// 	// if no key exists this will return empty string
+func (app *application) readString(qs url.Values, key string, defaultValue string) string {
+	// Extract the value for a given key from the query string.
+	// if no key exists this will return empty string
 
-// 	s := qs.Get(key)
+	s := qs.Get(key)
 
-// 	// if no key exists (or the value is empty) then return the default value.
-// 	if s == "" {
-// 		return defaultValue
-// 	}
+	// if no key exists (or the value is empty) then return the default value.
+	if s == "" {
+		return defaultValue
+	}
 
-// 	// Otherwise return the string.
-// 	return s
-// }
+	// Otherwise return the string.
+	return s
+}
 
 // The readCSV() helper reads a string value from the query string and then splits it
 // into a slice on the comma character. If no matching key could be found, it returns
@@ -127,36 +130,38 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 // integer before returning. If no matching key could be found it returns the provided
 // default value. If the value couldn't be converted to an integer, then we record an
 // error message in the provided Validator instance.
-// func (app *application) readInt(qs url.Values, key string, defaultValue int, v *validator.Validator) int {
-// 	// Extract the value from the query string.
-// 	s := qs.Get(key)
+func (app *application) readInt(qs url.Values, key string, defaultValue int, v *validator.Validator) int {
+	// Extract the value from the query string.
+	s := qs.Get(key)
 
-// 	// if no key exists (or the value is empty) then return the default value.
-// 	if s == "" {
-// 		return defaultValue
-// 	}
+	// if no key exists (or the value is empty) then return the default value.
+	if s == "" {
+		return defaultValue
+	}
 
-// 	// Try to convert the value to an int. If this fails, add an error message to the
-// 	// validator instance and return the default value.
+	// Try to convert the value to an int. If this fails, add an error message to the
+	// validator instance and return the default value.
 
-// 	i, err := strconv.Atoi(s)
-// 	if err != nil {
-// 		v.AddError(key, "must be an integer value")
-// 		return defaultValue
-// 	}
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		v.AddError(key, "must be an integer value")
+		return defaultValue
+	}
 
-// 	// Otherwise, return the converted integer value.
-// 	return i
-// }
+	// Otherwise, return the converted integer value.
+	return i
+}
 
 // The background() helper accepts an arbitrary function as a parameter.
 func (app *application) background(fn func()) {
 
 	app.wg.Add(1)
+	app.metrics.backgroundWorkers.Inc()
 	// Launch a background goroutine.
 	go func() {
 		// recover any panic
 		defer app.wg.Done()
+		defer app.metrics.backgroundWorkers.Dec()
 
 		defer func() {
 			if err := recover(); err != nil {
@@ -168,3 +173,26 @@ func (app *application) background(fn func()) {
 		fn()
 	}()
 }
+
+// The sendEmail() helper sends a templated email in a background goroutine, so that the
+// client doesn't have to wait for the mail server. Delivery is attempted up to three
+// times, sleeping for a moment between attempts, before the error is logged.
+func (app *application) sendEmail(recipient, templateFile string, data interface{}) {
+	app.background(func() {
+		var err error
+
+		for i := 1; i <= 3; i++ {
+			err = app.mailer.Send(recipient, templateFile, data)
+			if err == nil {
+				return
+			}
+
+			// If it didn't work, sleep for a short time and try again.
+			time.Sleep(time.Duration(i) * 500 * time.Millisecond)
+		}
+
+		app.logger.PrintError(err, jsonlog.Fields{
+			"template": templateFile,
+		})
+	})
+}
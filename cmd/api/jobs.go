@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/JacobNewton007/sendchamp-go-test/internal/data"
+)
+
+func (app *application) showJobHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDparam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	// Fetch the job, scoped to the current user. Jobs belonging to other users are
+	// reported as not found.
+	job, err := app.modelsFor(r).Jobs.Get(id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Once the job has succeeded, point the client at the task that was created.
+	headers := make(http.Header)
+	if job.Status == data.JobSucceeded {
+		headers.Set("Location", fmt.Sprintf("/v1/tasks/%d", job.TaskID))
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"job": job}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -3,18 +3,25 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/JacobNewton007/sendchamp-go-test/internal/data"
+	_ "github.com/JacobNewton007/sendchamp-go-test/internal/data/memory"
+	_ "github.com/JacobNewton007/sendchamp-go-test/internal/data/postgres"
+	_ "github.com/JacobNewton007/sendchamp-go-test/internal/data/sqlite"
 	"github.com/JacobNewton007/sendchamp-go-test/internal/jsonlog"
+	"github.com/JacobNewton007/sendchamp-go-test/internal/jwtauth"
+	"github.com/JacobNewton007/sendchamp-go-test/internal/mailer"
 	"github.com/JacobNewton007/sendchamp-go-test/internal/rabbitmq"
+	"github.com/JacobNewton007/sendchamp-go-test/internal/telemetry"
 	_ "github.com/go-sql-driver/mysql"
-	"github.com/rabbitmq/amqp091-go"
 )
 
 var (
@@ -23,15 +30,20 @@ var (
 )
 
 type config struct {
-	port int
-	env  string
-	db   struct {
+	port          int
+	adminPort     int
+	env           string
+	shutdownDelay time.Duration
+	db            struct {
+		driver   string
 		dsn      string
 		username string
 		password string
 		hostname string
 		dbname   string
 
+		autoMigrate bool
+
 		maxOpenConns int
 		maxIdleConns int
 		maxIdleTime  string
@@ -50,23 +62,88 @@ type config struct {
 	cors struct {
 		trustedOrigins []string
 	}
+
+	smtp struct {
+		host     string
+		port     int
+		username string
+		password string
+		sender   string
+	}
+
+	mailer struct {
+		backend string
+		file    string
+	}
+
+	log struct {
+		level       string
+		stackTraces bool
+		output      string
+		maxSize     int
+		maxAge      time.Duration
+		maxBackups  int
+		compress    bool
+	}
+
+	otel struct {
+		exporter    string
+		endpoint    string
+		insecure    bool
+		sampleRatio float64
+	}
+
+	auth struct {
+		mode           string
+		accessTokenTTL time.Duration
+		jwt            struct {
+			alg      string
+			keys     string
+			issuer   string
+			audience string
+		}
+	}
 }
 
 type application struct {
 	config config
 	logger *jsonlog.Logger
-	models data.Models
-	rMq    rabbitmq.RabbitMQ
-	wg     sync.WaitGroup
+	// logOutput is where the logger writes to. It's kept so that log files can be
+	// rotated on SIGHUP.
+	logOutput io.WriteCloser
+	// db is the connection pool behind the models, used by the readiness check. It
+	// is nil for the in-memory backend.
+	db      *sql.DB
+	models  data.Models
+	metrics *metrics
+	jwt     *jwtauth.Authority
+	mailer  mailer.Mailer
+	rMq     rabbitmq.RabbitMQ
+	// inProcessQueue is set when running without RabbitMQ. The outbox relay then
+	// hands tasks straight to processTask() instead of publishing them, and no
+	// consumer is started.
+	inProcessQueue bool
+	wg             sync.WaitGroup
+	// outboxNudge wakes the outbox relay up when a message has been written to the
+	// outbox. It's buffered, so nudging never blocks.
+	outboxNudge chan struct{}
+	// shuttingDown is set to 1 when the server receives a signal to stop, which
+	// makes the readiness check fail.
+	shuttingDown int32
 }
 
 func main() {
 	var cfg config
 
 	flag.IntVar(&cfg.port, "port", 4000, "API server ports")
+	flag.IntVar(&cfg.adminPort, "admin-port", 4001, "Admin server port for /metrics (0 to disable)")
 	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
+	flag.DurationVar(&cfg.shutdownDelay, "shutdown-delay", 5*time.Second, "How long to keep serving after SIGTERM, so load balancers can stop sending traffic")
+
+	flag.StringVar(&cfg.db.driver, "db-driver", "mysql", "Storage backend (mysql|postgres|sqlite|memory)")
+	flag.StringVar(&cfg.db.dsn, "db-dsn", "", "Database DSN (for sqlite, e.g. file:sendchamp.db?_pragma=foreign_keys(1))")
 
-	flag.StringVar(&cfg.db.dsn, "db-dsn", "", "MySQL DSN")
+	flag.BoolVar(&cfg.db.autoMigrate, "db-auto-migrate", false, "Apply pending database migrations on startup")
 
 	// Read the connection pool settings from command-line flags into the config struct.
 	// Notice the default values that we're using?
@@ -80,7 +157,53 @@ func main() {
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
 
-	flag.StringVar(&cfg.rabbitmq.uri, "rabbitmq-uri", "", "RabbitMQ uri")
+	flag.StringVar(&cfg.rabbitmq.uri, "rabbitmq-uri", "", "RabbitMQ uri (optional with -db-driver=memory, which then processes tasks in-process)")
+
+	// Read the mailer settings into the config struct. The stdout and file backends
+	// don't deliver anything and are meant for local development.
+	flag.StringVar(&cfg.mailer.backend, "mailer", "smtp", "Mailer backend (smtp|stdout|file)")
+	flag.StringVar(&cfg.mailer.file, "mailer-file", "mail.log", "File the file mailer backend writes to")
+
+	flag.StringVar(&cfg.smtp.host, "smtp-host", "localhost", "SMTP host")
+	flag.IntVar(&cfg.smtp.port, "smtp-port", 25, "SMTP port")
+	flag.StringVar(&cfg.smtp.username, "smtp-username", "", "SMTP username")
+	flag.StringVar(&cfg.smtp.password, "smtp-password", "", "SMTP password")
+	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Sendchamp <no-reply@sendchamp.com>", "SMTP sender")
+
+	// Read the authentication settings. In "jwt" mode authentication tokens are signed
+	// JWTs which are verified without a token lookup. The first key in -jwt-keys signs
+	// new tokens, and any listed key is accepted when verifying. Because of that,
+	// revoking tokens in jwt mode only revokes refresh tokens: access tokens which have
+	// already been issued stay valid until they expire, so -access-token-ttl should be
+	// kept short when using it. The JWTs only carry the user ID, so routes which need an
+	// activated user or a permission still read the user and their permissions from the
+	// database.
+	flag.StringVar(&cfg.auth.mode, "auth-mode", "token", "Authentication token mode (token|jwt); jwt still reads users and permissions from the database")
+	flag.DurationVar(&cfg.auth.accessTokenTTL, "access-token-ttl", 24*time.Hour, "Lifetime of access tokens (refresh tokens last 30 days)")
+	flag.StringVar(&cfg.auth.jwt.alg, "jwt-alg", "HS256", "JWT signing algorithm (HS256|EdDSA)")
+	flag.StringVar(&cfg.auth.jwt.keys, "jwt-keys", "", "JWT keys as space separated kid:secret pairs, signing key first")
+	flag.StringVar(&cfg.auth.jwt.issuer, "jwt-issuer", "sendchamp-go-test", "JWT issuer")
+	flag.StringVar(&cfg.auth.jwt.audience, "jwt-audience", "sendchamp-go-test", "JWT audience")
+
+	// Read the logging settings. The level can also be switched to debug and back at
+	// runtime by sending the process a SIGUSR1 signal.
+	flag.StringVar(&cfg.log.level, "log-level", "info", "Minimum log level (debug|info|warn|error|fatal|off)")
+	flag.BoolVar(&cfg.log.stackTraces, "log-stack-traces", false, "Include stack traces in error log entries")
+
+	// Read the log output settings. Log files are rotated when they reach the maximum
+	// size or age, or when the process receives a SIGHUP signal.
+	flag.StringVar(&cfg.log.output, "log-output", "stdout", "Log output (stdout|syslog|path to a log file)")
+	flag.IntVar(&cfg.log.maxSize, "log-max-size", 100, "Maximum log file size in megabytes before it is rotated (0 for no limit)")
+	flag.DurationVar(&cfg.log.maxAge, "log-max-age", 24*time.Hour, "Maximum age of a log file before it is rotated (0 for no limit)")
+	flag.IntVar(&cfg.log.maxBackups, "log-max-backups", 7, "Number of rotated log files to keep (0 to keep all)")
+	flag.BoolVar(&cfg.log.compress, "log-compress", true, "Gzip rotated log files")
+
+	// Read the tracing settings. Spans are sent to an OpenTelemetry collector with the
+	// otlp exporter, or printed with the stdout exporter when working locally.
+	flag.StringVar(&cfg.otel.exporter, "otel-exporter", "none", "Trace exporter (none|stdout|otlp)")
+	flag.StringVar(&cfg.otel.endpoint, "otel-endpoint", "localhost:4318", "OTLP/HTTP collector host:port")
+	flag.BoolVar(&cfg.otel.insecure, "otel-insecure", false, "Send spans to the OTLP collector over plain HTTP")
+	flag.Float64Var(&cfg.otel.sampleRatio, "otel-sample-ratio", 1, "Fraction of new traces to sample (0 to 1)")
 
 	flag.Func("cors-trusted-origins", "Trusted CORS origins (space separated)", func(val string) error {
 		cfg.cors.trustedOrigins = strings.Fields(val)
@@ -98,29 +221,143 @@ func main() {
 	}
 	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
 
-	db, err := openDB(cfg)
+	level, err := jsonlog.ParseLevel(cfg.log.level)
 	if err != nil {
 		logger.PrintFatal(err, nil)
 	}
-	// Defer a call to db.Close() so that the connection pool is closed before the
-	// main() function exits.
-	defer db.Close()
-	logger.PrintInfo("database connection pool established", nil)
 
-	rabbitConn, err := OpenRabbitQueue(cfg)
+	// Errors opening the log output are still written to stdout, as there's nowhere
+	// else for them to go.
+	logOutput, err := openLogOutput(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	defer logOutput.Close()
+
+	logger = jsonlog.New(logOutput, level)
+	logger.SetStackTraces(cfg.log.stackTraces)
+
+	// "api [flags] migrate ..." manages the database schema with the embedded
+	// migrations and exits, without starting the server.
+	if flag.Arg(0) == "migrate" {
+		if cfg.db.driver == "memory" {
+			logger.PrintFatal(errors.New("the memory backend has no schema to migrate"), nil)
+		}
+
+		db, err := openDB(cfg)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		defer db.Close()
+
+		err = runMigrate(cfg, db, flag.Args()[1:])
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		return
+	}
+
+	shutdownTracing, err := telemetry.Setup(context.Background(), telemetry.Config{
+		Exporter:       cfg.otel.exporter,
+		Endpoint:       cfg.otel.endpoint,
+		Insecure:       cfg.otel.insecure,
+		SampleRatio:    cfg.otel.sampleRatio,
+		ServiceName:    "sendchamp-api",
+		ServiceVersion: version,
+		Stdout:         os.Stdout,
+	})
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	// Flush any spans which haven't been exported yet before exiting.
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := shutdownTracing(ctx); err != nil {
+			logger.PrintError(err, nil)
+		}
+	}()
+
+	mail, err := openMailer(cfg)
 	if err != nil {
 		logger.PrintFatal(err, nil)
 	}
 
-	defer rabbitConn.Close()
-	logger.PrintInfo("rabbitmq connection pool established", nil)
-	// Use the data.NewModels() function to initialize a Models struct, passing in the
-	// connection pool as a parameter.
+	if cfg.auth.accessTokenTTL <= 0 {
+		logger.PrintFatal(errors.New("-access-token-ttl must be positive"), nil)
+	}
+
+	jwtAuthority, err := openJWTAuthority(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	// The in-memory backend doesn't need a database, so only open a connection pool
+	// for the SQL backends.
+	var db *sql.DB
+
+	if cfg.db.driver != "memory" {
+		db, err = openDB(cfg)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		// Defer a call to db.Close() so that the connection pool is closed before the
+		// main() function exits.
+		defer db.Close()
+		logger.PrintInfo("database connection pool established", nil)
+
+		if cfg.db.autoMigrate {
+			err = autoMigrate(cfg, db, logger)
+			if err != nil {
+				logger.PrintFatal(err, nil)
+			}
+		}
+	}
+
+	// Use the data.NewModels() function to initialize a Models struct for the
+	// configured backend, passing in the connection pool as a parameter.
+	models, err := data.NewModels(cfg.db.driver, db)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	metrics := newMetrics(db)
+
+	// Connect to RabbitMQ. If the connection is lost later on it's re-established in
+	// the background, so a broker restart doesn't take the API down with it. The
+	// memory backend is meant for trying the API out, so if it's used without
+	// -rabbitmq-uri the tasks are processed in-process instead.
+	var rMq rabbitmq.RabbitMQ
+
+	inProcessQueue := cfg.db.driver == "memory" && cfg.rabbitmq.uri == ""
+
+	if inProcessQueue {
+		logger.PrintInfo("no rabbitmq uri given, processing tasks in-process", nil)
+	} else {
+		rabbitConn, err := rabbitmq.Dial(cfg.rabbitmq.uri, logger)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+
+		defer rabbitConn.Close()
+		logger.PrintInfo("rabbitmq connection established", nil)
+
+		rMq = rabbitmq.NewMq(rabbitConn, logger, metrics.rabbitmq)
+	}
+
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		rMq:    rabbitmq.NewMq(rabbitConn),
+		config:         cfg,
+		logger:         logger,
+		logOutput:      logOutput,
+		db:             db,
+		metrics:        metrics,
+		models:         models,
+		jwt:            jwtAuthority,
+		mailer:         mail,
+		rMq:            rMq,
+		inProcessQueue: inProcessQueue,
+		outboxNudge:    make(chan struct{}, 1),
 	}
 
 	err = app.server()
@@ -132,10 +369,17 @@ func main() {
 func openDB(cfg config) (*sql.DB, error) {
 	// Use sql.Open() to create an empty connection pool, using the DSN from the config
 	// struct.
-	db, err := sql.Open("mysql", cfg.db.dsn)
+	db, err := sql.Open(cfg.db.driver, cfg.db.dsn)
 	if err != nil {
 		return nil, err
 	}
+
+	// SQLite only allows one writer at a time, so rather than have concurrent writes
+	// fail with SQLITE_BUSY we funnel everything through a single connection.
+	if cfg.db.driver == "sqlite" {
+		cfg.db.maxOpenConns = 1
+	}
+
 	// set the maximum number of open (in-use + idle) connections in the pool. Note that
 	// passing a value less than or equal to 0 will mean there is no limit
 	db.SetMaxOpenConns(cfg.db.maxOpenConns)
@@ -166,12 +410,64 @@ func openDB(cfg config) (*sql.DB, error) {
 	return db, nil
 }
 
-func OpenRabbitQueue(cfg config) (*amqp091.Connection, error) {
-	conn, err := amqp091.Dial(cfg.rabbitmq.uri)
-	if err != nil {
-		panic(err)
+// The openLogOutput() function returns the destination for log entries selected with
+// -log-output. Anything other than "stdout" or "syslog" is the path of a log file.
+func openLogOutput(cfg config) (io.WriteCloser, error) {
+	switch cfg.log.output {
+	case "stdout":
+		// Closing stdout when main() returns would be harmless, but there's no need.
+		return nopCloser{os.Stdout}, nil
+	case "syslog":
+		return jsonlog.NewSyslog("sendchamp-api")
+	default:
+		return jsonlog.OpenFile(cfg.log.output, jsonlog.RotateOptions{
+			MaxSize:    int64(cfg.log.maxSize) * 1024 * 1024,
+			MaxAge:     cfg.log.maxAge,
+			MaxBackups: cfg.log.maxBackups,
+			Compress:   cfg.log.compress,
+		})
+	}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// The openMailer() function returns the mailer backend selected in the config.
+func openMailer(cfg config) (mailer.Mailer, error) {
+	switch cfg.mailer.backend {
+	case "smtp":
+		return mailer.NewSMTP(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender), nil
+	case "stdout":
+		return mailer.NewFile(os.Stdout, cfg.smtp.sender), nil
+	case "file":
+		f, err := os.OpenFile(cfg.mailer.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		return mailer.NewFile(f, cfg.smtp.sender), nil
+	default:
+		return nil, fmt.Errorf("unknown mailer backend %q", cfg.mailer.backend)
+	}
+}
+
+// The openJWTAuthority() function returns the JWT authority when running in "jwt"
+// authentication mode, and nil when authentication tokens are stored in the database.
+func openJWTAuthority(cfg config) (*jwtauth.Authority, error) {
+	switch cfg.auth.mode {
+	case "token":
+		return nil, nil
+	case "jwt":
+		keys, err := jwtauth.ParseKeys(cfg.auth.jwt.alg, cfg.auth.jwt.keys)
+		if err != nil {
+			return nil, err
+		}
+		return jwtauth.New(cfg.auth.jwt.alg, keys, cfg.auth.jwt.issuer, cfg.auth.jwt.audience)
+	default:
+		return nil, fmt.Errorf("unknown auth mode %q", cfg.auth.mode)
 	}
-	return conn, nil
 }
 
 // func dsn(username, password, hostname, dbName string) string {
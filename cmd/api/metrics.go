@@ -0,0 +1,116 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/JacobNewton007/sendchamp-go-test/internal/rabbitmq"
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// unmatchedRoute is the route label for requests which didn't match any route. Using
+// the raw path instead would let clients create an unbounded number of series.
+const unmatchedRoute = "unmatched"
+
+// metrics holds the Prometheus collectors for the application. They're registered
+// with their own registry rather than the global default one, so that only the
+// metrics we choose are exported.
+type metrics struct {
+	registry *prometheus.Registry
+
+	requests          *prometheus.CounterVec
+	requestDuration   *prometheus.HistogramVec
+	rateLimited       prometheus.Counter
+	backgroundWorkers prometheus.Gauge
+
+	rabbitmq *rabbitmq.Metrics
+}
+
+// The newMetrics() function creates and registers the collectors. The db may be nil
+// when using the in-memory storage backend, in which case there are no connection pool
+// metrics.
+func newMetrics(db *sql.DB) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "HTTP requests served, by route pattern, method and status code.",
+		}, []string{"route", "method", "status"}),
+
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Time taken to serve HTTP requests, by route pattern and method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+
+		rateLimited: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "http_rate_limited_requests_total",
+			Help: "Requests rejected by the rate limiter.",
+		}),
+
+		backgroundWorkers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "background_goroutines",
+			Help: "Background goroutines started with app.background() which are still running.",
+		}),
+
+		rabbitmq: rabbitmq.NewMetrics(),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.rateLimited,
+		m.backgroundWorkers,
+	)
+	m.registry.MustRegister(m.rabbitmq.Collectors()...)
+
+	if db != nil {
+		m.registry.MustRegister(collectors.NewDBStatsCollector(db, "sendchamp"))
+	}
+
+	return m
+}
+
+// The observeRequest() method records a served request. It's called by the logRequest()
+// middleware, which already knows the status code and how long the request took.
+func (m *metrics) observeRequest(route, method string, status int, duration time.Duration) {
+	if route == "" {
+		route = unmatchedRoute
+	}
+
+	m.requests.WithLabelValues(route, method, strconv.Itoa(status)).Inc()
+	m.requestDuration.WithLabelValues(route, method).Observe(duration.Seconds())
+}
+
+// The tagRoute() middleware records the route pattern a request matched, so that
+// metrics can be labelled with "/v1/tasks/:id" instead of every individual task URL.
+func (app *application) tagRoute(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if info, ok := r.Context().Value(requestInfoContextKey).(*requestInfo); ok {
+			info.route = pattern
+		}
+
+		next(w, r)
+	}
+}
+
+// The adminRoutes() method returns the handler for the admin server, which listens on
+// its own port so that it doesn't need to be exposed to the internet.
+func (app *application) adminRoutes() http.Handler {
+	router := httprouter.New()
+
+	router.Handler(http.MethodGet, "/metrics", promhttp.HandlerFor(app.metrics.registry, promhttp.HandlerOpts{
+		ErrorLog: log.New(app.logger, "", 0),
+	}))
+
+	return app.recoverPanic(router)
+}
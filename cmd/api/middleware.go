@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/http"
@@ -9,8 +11,14 @@ import (
 	"time"
 
 	"github.com/JacobNewton007/sendchamp-go-test/internal/data"
+	"github.com/JacobNewton007/sendchamp-go-test/internal/jsonlog"
 	"github.com/JacobNewton007/sendchamp-go-test/internal/validator"
 	"github.com/tomasen/realip"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/time/rate"
 )
 
@@ -97,6 +105,7 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 			// response, just like before.
 			if !clients[ip].limiter.Allow() {
 				mu.Unlock()
+				app.metrics.rateLimited.Inc()
 				app.rateLimitExceededResponse(w, r)
 				return
 			}
@@ -147,6 +156,28 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 
 		token := headerParts[1]
 
+		// In JWT mode the token is verified without touching the database. Only the
+		// user ID is known at this point, so we store a loader which fetches the full
+		// user record if and when a later handler needs it. The requireActivatedUser()
+		// and requirePermission() middleware do, so routes behind them still hit the
+		// database on every request.
+		if app.jwt != nil {
+			userID, err := app.jwt.Verify(token)
+			if err != nil {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			r = app.contextSetUser(r, &data.User{ID: userID})
+			r = app.contextSetUserLoader(r, func() (*data.User, error) {
+				return app.modelsFor(r).Users.Get(userID)
+			})
+			r = app.contextSetToken(r, token)
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		// Validate the token to make sure it is in a sensible format.
 		v := validator.New()
 
@@ -159,7 +190,7 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		user, err := app.modelsFor(r).Users.GetForToken(data.ScopeAuthentication, token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -171,8 +202,11 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		}
 
 		// Call the contextSetUser() helper to add the user information to the request
-		// context.
+		// context, along with the token itself so that it can be revoked on logout.
+		// Because the token is looked up on every request, a revoked token stops
+		// working immediately.
 		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, token)
 
 		next.ServeHTTP(w, r)
 	})
@@ -194,8 +228,20 @@ func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.Han
 
 func (app *application) requireActivatedUser(next http.HandlerFunc) http.HandlerFunc {
 	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		user := app.contextGetUser(r)
-		fmt.Println("user 1 :::::::", user.Activated)
+		// Load the full user record, as the one in the request context may only have
+		// its ID set.
+		user, err := app.contextLoadUser(r)
+		if err != nil {
+			switch {
+			// The user has been deleted since their token was issued.
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.invalidAuthenticationTokenResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
 		if user.Activated == 0 {
 			app.inactiveAccountResponse(w, r)
 			return
@@ -208,6 +254,36 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 	return app.requireAuthenticatedUser(fn)
 }
 
+// Note that the first parameter for the middleware function is the permission code that
+// we require the user to have.
+func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		// Retrieve the user from the request context.
+		user := app.contextGetUser(r)
+
+		// Get the slice of permissions for the user.
+		permissions, err := app.modelsFor(r).Permissions.GetAllForUser(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		// Check if the slice includes the required permission. If it doesn't, then
+		// return a 403 Forbidden response.
+		if !permissions.Include(code) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		// Otherwise they have the required permission so we call the next handler in
+		// the chain.
+		next.ServeHTTP(w, r)
+	}
+
+	// Wrap this with the requireActivatedUser() middleware before returning it.
+	return app.requireActivatedUser(fn)
+}
+
 func (app *application) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Vary", "Origin")
@@ -220,11 +296,12 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 			for i := range app.config.cors.trustedOrigins {
 				if origin == app.config.cors.trustedOrigins[i] {
 					w.Header().Set("Access-Control-Allow-Origin", origin)
+					w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
 
 					if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
 
 						w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Request-ID")
 
 						w.WriteHeader(http.StatusOK)
 						return
@@ -236,3 +313,163 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// The requestID() middleware gives every request an ID, which is echoed back in the
+// X-Request-ID response header and included in the logs and error responses for the
+// request. If the client (or a proxy in front of us) already sent a sensible
+// X-Request-ID header we reuse it, so that a request can be traced across services.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+
+		if !validRequestID(id) {
+			var err error
+			id, err = generateRequestID()
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+
+		w.Header().Set("X-Request-ID", id)
+
+		r = app.contextSetRequestID(r, id)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The validRequestID() helper reports whether a client-supplied request ID is safe to
+// reuse. We only accept short IDs made up of characters which can't be used to forge
+// log lines or headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// The generateRequestID() helper returns a new random request ID.
+func generateRequestID() (string, error) {
+	b := make([]byte, 16)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// The logRequest() middleware writes one access log line for every request once it
+// has been served, records the request in the metrics and starts the server span for
+// its trace. It needs to run outside recoverPanic(), so that the 500 responses sent for
+// panics are logged too.
+func (app *application) logRequest(next http.Handler) http.Handler {
+	tracer := otel.Tracer("github.com/JacobNewton007/sendchamp-go-test/cmd/api")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		// The user is only known once the authenticate() middleware further down the
+		// chain has run, so we put somewhere for contextSetUser() to record it.
+		info := &requestInfo{}
+		r = app.contextSetRequestInfo(r, info)
+
+		// Continue the caller's trace if they sent a traceparent header. The span is
+		// renamed after the route once the router has matched one.
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", r.Method),
+				attribute.String("http.target", r.URL.Path),
+				attribute.String("http.request_id", app.contextGetRequestID(r)),
+			),
+		)
+		defer span.End()
+
+		r = r.WithContext(ctx)
+
+		lw := &loggingResponseWriter{ResponseWriter: w}
+
+		next.ServeHTTP(lw, r)
+
+		// If nothing was written the net/http server sends a 200 OK.
+		if lw.status == 0 {
+			lw.status = http.StatusOK
+		}
+
+		properties := jsonlog.Fields{
+			"request_method": r.Method,
+			"request_path":   r.URL.Path,
+			"status":         lw.status,
+			"bytes":          lw.bytes,
+			"latency":        time.Since(start),
+			"client_ip":      realip.FromRequest(r),
+		}
+
+		if info.userID != 0 {
+			properties["user_id"] = info.userID
+		}
+
+		if info.route != "" {
+			properties["route"] = info.route
+			span.SetName(r.Method + " " + info.route)
+			span.SetAttributes(attribute.String("http.route", info.route))
+		}
+
+		span.SetAttributes(attribute.Int("http.status_code", lw.status))
+		if lw.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(lw.status))
+		}
+
+		if sc := span.SpanContext(); sc.IsSampled() {
+			properties["trace_id"] = sc.TraceID().String()
+		}
+
+		app.requestLogger(r).PrintInfo("request served", properties)
+
+		app.metrics.observeRequest(info.route, r.Method, lw.status, time.Since(start))
+	})
+}
+
+// loggingResponseWriter wraps a http.ResponseWriter to record the status code and the
+// number of bytes written for the access log.
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (lw *loggingResponseWriter) WriteHeader(status int) {
+	if lw.status == 0 {
+		lw.status = status
+	}
+	lw.ResponseWriter.WriteHeader(status)
+}
+
+func (lw *loggingResponseWriter) Write(b []byte) (int, error) {
+	if lw.status == 0 {
+		lw.status = http.StatusOK
+	}
+	n, err := lw.ResponseWriter.Write(b)
+	lw.bytes += n
+	return n, err
+}
+
+// Unwrap returns the underlying http.ResponseWriter, so that http.ResponseController
+// can reach any optional interfaces it implements.
+func (lw *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/JacobNewton007/sendchamp-go-test/internal/jsonlog"
+	"github.com/JacobNewton007/sendchamp-go-test/internal/migrate"
+	"github.com/JacobNewton007/sendchamp-go-test/migrations"
+)
+
+const migrateUsage = "usage: api [flags] migrate up|down [N]|status|force VERSION"
+
+// The runMigrate() function implements the "migrate" mode of the binary, which
+// manages the database schema and then exits instead of starting the server. The args
+// are the command-line arguments following the word "migrate".
+func runMigrate(cfg config, db *sql.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	migrator, err := migrate.New(db, cfg.db.driver, migrations.FS)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, migration := range applied {
+			fmt.Printf("applied %d_%s\n", migration.Version, migration.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("no change")
+		}
+		return err
+
+	case "down":
+		// Roll back a single migration unless told otherwise, so that a stray
+		// "migrate down" can't wipe out the whole database.
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+
+		reverted, err := migrator.Down(ctx, steps)
+		for _, migration := range reverted {
+			fmt.Printf("rolled back %d_%s\n", migration.Version, migration.Name)
+		}
+		if err == nil && len(reverted) == 0 {
+			fmt.Println("no change")
+		}
+		return err
+
+	case "status":
+		version, dirty, statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Version:\t%d\n", version)
+		fmt.Printf("Dirty:\t\t%t\n\n", dirty)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		for _, status := range statuses {
+			state := "pending"
+			if status.Applied {
+				state = "applied"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", status.Version, status.Name, state)
+		}
+		return w.Flush()
+
+	case "force":
+		if len(args) != 2 {
+			return errors.New(migrateUsage)
+		}
+
+		version, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || version < 0 {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+
+		err = migrator.Force(ctx, version)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("forced version %d\n", version)
+		return nil
+
+	default:
+		return errors.New(migrateUsage)
+	}
+}
+
+// The autoMigrate() function applies any pending migrations when the server starts
+// with -db-auto-migrate.
+func autoMigrate(cfg config, db *sql.DB, logger *jsonlog.Logger) error {
+	migrator, err := migrate.New(db, cfg.db.driver, migrations.FS)
+	if err != nil {
+		return err
+	}
+
+	applied, err := migrator.Up(context.Background())
+	for _, migration := range applied {
+		logger.PrintInfo("applied database migration", jsonlog.Fields{
+			"version": strconv.FormatInt(migration.Version, 10),
+			"name":    migration.Name,
+		})
+	}
+
+	return err
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/JacobNewton007/sendchamp-go-test/internal/data"
+	"github.com/JacobNewton007/sendchamp-go-test/internal/jsonlog"
+	"github.com/JacobNewton007/sendchamp-go-test/internal/rabbitmq"
+)
+
+const (
+	// outboxRelayInterval is how often the relay checks the outbox for messages
+	// which it wasn't nudged about, like ones left over from a broker outage.
+	outboxRelayInterval = time.Second
+
+	// outboxBatchSize is the number of messages the relay publishes in one go.
+	outboxBatchSize = 100
+)
+
+// The startOutboxRelay() helper launches the goroutine which publishes the messages
+// written to the outbox. It runs until ctx is cancelled, and like the task worker it is
+// tracked by app.wg, so the graceful shutdown waits for the batch in hand.
+//
+// A message is only marked as sent once RabbitMQ has confirmed it, so delivery is
+// at-least-once: if we stop between the two, the message is published again.
+func (app *application) startOutboxRelay(ctx context.Context) {
+	app.background(func() {
+		app.logger.PrintInfo("starting outbox relay", nil)
+
+		ticker := time.NewTicker(outboxRelayInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				app.logger.PrintInfo("stopped outbox relay", nil)
+				return
+			case <-ticker.C:
+			case <-app.outboxNudge:
+			}
+
+			app.relayOutbox(ctx)
+		}
+	})
+}
+
+// The nudgeOutboxRelay() helper tells the relay that there's a new message in the
+// outbox. It never blocks: if the relay has already been nudged, it will pick this
+// message up too.
+func (app *application) nudgeOutboxRelay() {
+	select {
+	case app.outboxNudge <- struct{}{}:
+	default:
+	}
+}
+
+// The relayOutbox() method publishes batches of messages from the outbox until it runs
+// out or publishing fails, in which case the rest are left for the next attempt.
+func (app *application) relayOutbox(ctx context.Context) {
+	// There's no point in trying while the connection is down; the messages are safe
+	// in the outbox until it's back.
+	if app.rMq.IsClosed() && !app.inProcessQueue {
+		return
+	}
+
+	publish := app.rMq.Publish
+	if app.inProcessQueue {
+		publish = app.processInProcess
+	}
+
+	for ctx.Err() == nil {
+		var publishErr error
+
+		sent, err := app.models.Outbox.Relay(outboxBatchSize, func(msg *data.OutboxMessage) error {
+			err := publish(ctx, rabbitmq.Message{
+				ID:      strconv.FormatInt(msg.ID, 10),
+				Topic:   msg.Topic,
+				Body:    msg.Payload,
+				Headers: msg.Headers,
+			})
+			if err != nil && publishErr == nil {
+				publishErr = err
+			}
+			return err
+		})
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		if publishErr != nil {
+			app.logger.PrintWarn("outbox messages not published, will retry", jsonlog.Fields{
+				"error": publishErr,
+				"sent":  sent,
+			})
+			return
+		}
+
+		if sent < outboxBatchSize {
+			return
+		}
+	}
+}
+
+// The processInProcess() method stands in for publishing when there's no broker. Tasks
+// are handed straight to processTask(), and events are dropped, as there's nobody to
+// listen to them. A task which fails with a temporary error stays in the outbox, so
+// the relay tries it again on its next pass.
+func (app *application) processInProcess(ctx context.Context, msg rabbitmq.Message) error {
+	if !msg.IsAddTask() {
+		return nil
+	}
+
+	// Like the worker, don't let stopping the relay cut short the task in hand.
+	taskCtx, task, err := rabbitmq.DecodeAddTask(msg)
+	if err != nil {
+		app.logger.PrintWarn("dropping undecodable message", jsonlog.Fields{
+			"message_id": msg.ID,
+			"error":      err,
+		})
+		return nil
+	}
+
+	err = app.processTask(taskCtx, task)
+	if errors.Is(err, rabbitmq.ErrInvalidTask) {
+		app.logger.PrintWarn("dropping task", jsonlog.Fields{
+			"job_id": task.JobID,
+			"error":  err,
+		})
+		return nil
+	}
+
+	return err
+}
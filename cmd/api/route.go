@@ -12,15 +12,46 @@ func (app *application) routes() http.Handler {
 
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
 
-	router.HandlerFunc(http.MethodGet, "/v1/tasks/:id", app.requireActivatedUser(app.GetTaskHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/tasks", app.requireActivatedUser(app.createTaskHandler))
-	router.HandlerFunc(http.MethodPatch, "/v1/tasks/:id", app.requireActivatedUser(app.updateTaskHandler))
-	router.HandlerFunc(http.MethodDelete, "/v1/tasks/:id", app.requireActivatedUser(app.deleteTaskHandler))
-
-	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
-	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
-
-	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
-
-	return app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router))))
+	// Register every route through handle(), which tags requests with the route
+	// pattern for the metrics.
+	handle := func(method, pattern string, handler http.HandlerFunc) {
+		router.HandlerFunc(method, pattern, app.tagRoute(pattern, handler))
+	}
+
+	handle(http.MethodGet, "/v1/tasks", app.requirePermission("tasks:read", app.listTasksHandler))
+	handle(http.MethodGet, "/v1/tasks/:id", app.requirePermission("tasks:read", app.GetTaskHandler))
+	handle(http.MethodPost, "/v1/tasks", app.requirePermission("tasks:write", app.createTaskHandler))
+	handle(http.MethodPatch, "/v1/tasks/:id", app.requirePermission("tasks:write", app.updateTaskHandler))
+	handle(http.MethodDelete, "/v1/tasks/:id", app.requirePermission("tasks:write", app.deleteTaskHandler))
+
+	handle(http.MethodGet, "/v1/jobs/:id", app.requirePermission("tasks:read", app.showJobHandler))
+
+	handle(http.MethodPost, "/v1/users", app.registerUserHandler)
+	handle(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	handle(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
+
+	handle(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	handle(http.MethodDelete, "/v1/tokens/authentication", app.requireAuthenticatedUser(app.deleteAuthenticationTokenHandler))
+	handle(http.MethodDelete, "/v1/tokens/authentication/all", app.requireAuthenticatedUser(app.deleteAllAuthenticationTokensHandler))
+	handle(http.MethodPost, "/v1/tokens/refresh", app.refreshAuthenticationTokenHandler)
+	handle(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
+	handle(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+
+	api := app.logRequest(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
+
+	// The health checks are served in front of the middleware chain. Load balancers
+	// poll them every few seconds, so they mustn't be rate limited or fill up the
+	// access log. Every other request falls through to the API.
+	//
+	// Only requestID() wraps both, so that every response, including an error from a
+	// health check, carries a request ID.
+	probes := httprouter.New()
+	probes.HandleMethodNotAllowed = false
+	probes.HandleOPTIONS = false
+	probes.NotFound = api
+
+	probes.HandlerFunc(http.MethodGet, "/healthz", app.livenessHandler)
+	probes.HandlerFunc(http.MethodGet, "/readyz", app.readinessHandler)
+
+	return app.requestID(probes)
 }
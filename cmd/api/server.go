@@ -8,8 +8,11 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	"github.com/JacobNewton007/sendchamp-go-test/internal/jsonlog"
 )
 
 func (app *application) server() error {
@@ -29,6 +32,46 @@ func (app *application) server() error {
 	// by the graceful Shutdown() function.
 	shutdownError := make(chan error)
 
+	// Start the task worker and the outbox relay with a cancellable context.
+	// Cancelling it during the graceful shutdown stops the consumer once its in-flight
+	// delivery has been acknowledged or requeued, and the relay once its batch is done.
+	workerCtx, stopWorker := context.WithCancel(context.Background())
+	defer stopWorker()
+
+	app.startTaskWorker(workerCtx)
+	app.startOutboxRelay(workerCtx)
+
+	go app.toggleDebugLogging()
+	go app.rotateLogsOnHangup()
+
+	// Start the admin server, which serves the metrics on a separate port. It's shut
+	// down along with the main server.
+	var adminSrv *http.Server
+
+	if app.config.adminPort != 0 {
+		adminSrv = &http.Server{
+			Addr:         fmt.Sprintf(":%d", app.config.adminPort),
+			Handler:      app.adminRoutes(),
+			ErrorLog:     log.New(app.logger, "", 0),
+			IdleTimeout:  time.Minute,
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 30 * time.Second,
+		}
+
+		go func() {
+			app.logger.PrintInfo("starting admin server", jsonlog.Fields{
+				"addr": adminSrv.Addr,
+			})
+
+			err := adminSrv.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) {
+				app.logger.PrintError(err, jsonlog.Fields{
+					"addr": adminSrv.Addr,
+				})
+			}
+		}()
+	}
+
 	go func() {
 		// Create a quit channel which carries os.Signal values.
 		quit := make(chan os.Signal, 1)
@@ -45,10 +88,22 @@ func (app *application) server() error {
 		// Log a message to say that the signal has been caught. Notice that we also
 		// call the String() method on the signal to get the signal name and include it
 		// in the log entry properties.
-		app.logger.PrintInfo("shutting down server", map[string]string{
+		app.logger.PrintInfo("shutting down server", jsonlog.Fields{
 			"signal": s.String(),
 		})
 
+		// Fail the readiness check straight away. On SIGTERM, which is what
+		// orchestrators send, keep serving for a while first so that load balancers
+		// notice and stop sending us new requests before the listener is closed.
+		atomic.StoreInt32(&app.shuttingDown, 1)
+
+		if s == syscall.SIGTERM && app.config.shutdownDelay > 0 {
+			app.logger.PrintInfo("waiting for load balancers to drain", jsonlog.Fields{
+				"delay": app.config.shutdownDelay,
+			})
+			time.Sleep(app.config.shutdownDelay)
+		}
+
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 		// Call Shutdown() on our server, passing in the context we just made.
@@ -57,21 +112,35 @@ func (app *application) server() error {
 		// because the shutdown didn't complete before the 5-second context deadline is
 		// hit). We relay this return value to the shutdownError channel.
 
+		if adminSrv != nil {
+			err := adminSrv.Shutdown(ctx)
+			if err != nil {
+				app.logger.PrintError(err, jsonlog.Fields{
+					"addr": adminSrv.Addr,
+				})
+			}
+		}
+
 		err := srv.Shutdown(ctx)
 		if err != nil {
 			shutdownError <- err
 		}
 
-		app.logger.PrintInfo("completing background tasks", map[string]string{
+		app.logger.PrintInfo("completing background tasks", jsonlog.Fields{
 			"addr": srv.Addr,
 		})
 
+		// Tell the task worker to stop consuming and the outbox relay to stop
+		// publishing. The wg.Wait() call below blocks until they have finished what
+		// they were doing and returned.
+		stopWorker()
+
 		app.wg.Wait()
 		shutdownError <- nil
 
 	}()
 
-	app.logger.PrintInfo("starting server", map[string]string{
+	app.logger.PrintInfo("starting server", jsonlog.Fields{
 		"addr": srv.Addr,
 		"env":  app.config.env,
 	})
@@ -94,9 +163,60 @@ func (app *application) server() error {
 
 	// At this point we know that the graceful shutdown completed successfully and we
 	// log a "stopped server" message.
-	app.logger.PrintInfo("stopped server", map[string]string{
+	app.logger.PrintInfo("stopped server", jsonlog.Fields{
 		"addr": srv.Addr,
 	})
 
 	return nil
 }
+
+// The toggleDebugLogging() method switches the logger to the DEBUG level when the
+// process receives a SIGUSR1 signal, and back to the configured level on the next one.
+// This lets us look at what a misbehaving server is doing without restarting it.
+func (app *application) toggleDebugLogging() {
+	configured := app.logger.Level()
+	if configured == jsonlog.LevelDebug {
+		configured = jsonlog.LevelInfo
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+
+	for range sig {
+		level := jsonlog.LevelDebug
+		if app.logger.Level() == jsonlog.LevelDebug {
+			level = configured
+		}
+
+		app.logger.SetLevel(level)
+		app.logger.PrintWarn("log level changed", jsonlog.Fields{
+			"level": level.String(),
+		})
+	}
+}
+
+// The rotateLogsOnHangup() method rotates the log file when the process receives a
+// SIGHUP signal, which is what logrotate and most other tools send. For outputs which
+// can't be rotated the signal is still caught, so that it doesn't stop the server.
+func (app *application) rotateLogsOnHangup() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+
+	for range sig {
+		rotator, ok := app.logOutput.(interface{ Rotate() error })
+		if !ok {
+			app.logger.PrintDebug("ignoring SIGHUP, log output can't be rotated", nil)
+			continue
+		}
+
+		err := rotator.Rotate()
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			continue
+		}
+
+		app.logger.PrintInfo("rotated log file", jsonlog.Fields{
+			"path": app.config.log.output,
+		})
+	}
+}
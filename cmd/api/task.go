@@ -1,73 +1,107 @@
 package main
 
 import (
-	// "encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 
-	// "time"
-
 	"github.com/JacobNewton007/sendchamp-go-test/internal/data"
 	"github.com/JacobNewton007/sendchamp-go-test/internal/rabbitmq"
 	"github.com/JacobNewton007/sendchamp-go-test/internal/validator"
 )
 
+// queueRetryAfter is the number of seconds clients are told to wait before retrying
+// when a task couldn't be queued.
+const queueRetryAfter = 5
+
 func (app *application) createTaskHandler(w http.ResponseWriter, r *http.Request) {
-	// fmt.Fprintln(w, "create a new task")
+	var input struct {
+		Title     string `json:"title"`
+		CreatedBy string `json:"created_by"`
+	}
 
-	var input rabbitmq.AddTask
 	err := app.readJSON(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
 	}
 
-	app.rMq.Publisher(input)
-
-	taskJob := app.rMq.Worker()
+	user := app.contextGetUser(r)
 
-	// copy the values from the input struct to a new task struct.
+	// copy the values from the input struct to a new task struct. The task is owned
+	// by the authenticated user making the request.
 	task := &data.Tasks{
-		Title:     taskJob.Title,
-		CreatedBy: taskJob.CreatedBy,
+		Title:     input.Title,
+		CreatedBy: input.CreatedBy,
+		OwnerID:   user.ID,
 	}
 
 	// Initialize a new validator
 	v := validator.New()
 
 	// Call the ValidateTask() function and return a response containing the errors if
-	// any of the checks fail.
+	// any of the checks fail. The worker validates the task again when it consumes
+	// the message, but checking here means the client hears about bad input
+	// straight away.
 	if data.ValidateTask(v, task); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	fmt.Println("JOB ::::::::::::::", &task)
-	app.background(func() {
-		id, err := app.models.Tasks.Insert(task)
+	// Record a pending job for this task creation, so that the client has something
+	// to poll for the outcome. The message which hands the task over to the worker is
+	// written to the outbox in the same transaction, so the job can't be recorded
+	// without the task being queued, even if RabbitMQ is down right now. The relay
+	// started in server() publishes it.
+	job := &data.Job{UserID: user.ID}
+
+	err = app.modelsFor(r).Jobs.Insert(job, func(job *data.Job) (*data.OutboxMessage, error) {
+		msg, err := rabbitmq.NewAddTask(r.Context(), rabbitmq.AddTask{
+			JobID:     job.ID,
+			Title:     task.Title,
+			CreatedBy: task.CreatedBy,
+			OwnerID:   task.OwnerID,
+			RequestID: app.contextGetRequestID(r),
+		})
 		if err != nil {
-			app.logger.PrintError(err, nil)
-			return
+			return nil, err
 		}
-		task.ID = id
+
+		return &data.OutboxMessage{
+			AggregateType: data.AggregateJob,
+			AggregateID:   job.ID,
+			Topic:         msg.Topic,
+			Payload:       msg.Body,
+			Headers:       msg.Headers,
+		}, nil
 	})
+	if err != nil {
+		// If the database timed out or hit a deadlock, the job wasn't saved but is
+		// likely to be if the client tries again shortly.
+		if errors.Is(err, data.ErrTemporary) {
+			app.logError(r, err)
+			app.serviceUnavailableResponse(w, r, queueRetryAfter)
+			return
+		}
+
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 
-	// When sending a HTTP response, we want to include a Location header to let the
-	// client know which URL they can find the newly-created resource at. We make an
-	// empty http.Header map and then use the Set() method to add a new Location header,
-	// interpolating the system-generated ID for our new task in the URL.
+	// Wake the relay up, rather than leaving the task to wait for its next tick.
+	app.nudgeOutboxRelay()
 
+	// Include a Location header pointing at the job resource, where the client can
+	// find out the ID of the task once it has been created.
 	headers := make(http.Header)
-	headers.Set("Location", fmt.Sprintf("/v1/tasks/%d", task.ID))
+	headers.Set("Location", fmt.Sprintf("/v1/jobs/%d", job.ID))
 
-	// Write a JSON response with a 201 Created status code, the task data in the
-	// response body, and the Location header.
-	err = app.writeJSON(w, http.StatusCreated, envelope{"message": "task is being processed"}, headers)
+	// Write a JSON response with a 202 Accepted status code and the job, so the client
+	// knows the task has been queued but not yet created.
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"job": job, "message": "task is being processed"}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
-	// fmt.Fprintf(w, "%+v\n", input)
 }
 
 func (app *application) GetTaskHandler(w http.ResponseWriter, r *http.Request) {
@@ -80,8 +114,9 @@ func (app *application) GetTaskHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Call the Get() method to fetch the data for a specific task. We also need to
 	// use the errors.Is() function to check if it returns a data.ErrRecordNotFound
-	// error, in which case we send a 404 Not Found response to the client.
-	task, err := app.models.Tasks.Get(id)
+	// error, in which case we send a 404 Not Found response to the client. Tasks
+	// owned by other users are reported in exactly the same way.
+	task, err := app.modelsFor(r).Tasks.Get(id, app.contextGetUser(r).ID)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -97,6 +132,60 @@ func (app *application) GetTaskHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (app *application) listTasksHandler(w http.ResponseWriter, r *http.Request) {
+	// Define an input struct to hold the expected values from the request query
+	// string.
+	var input struct {
+		Title     string
+		CreatedBy string
+		data.Filters
+	}
+
+	v := validator.New()
+
+	// Call r.URL.Query() to get the url.Values map containing the query string data.
+	qs := r.URL.Query()
+
+	// Use our helpers to extract the title and created_by query string values, falling
+	// back to defaults of an empty string if they are not provided by the client.
+	input.Title = app.readString(qs, "title", "")
+	input.CreatedBy = app.readString(qs, "created_by", "")
+
+	// Get the page and page_size query string values as integers. Notice that we set
+	// the default page value to 1 and default page_size to 20, and that we pass the
+	// validator instance as the final argument here.
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	// Extract the sort query string value, falling back to "id" if it is not provided
+	// by the client (which will imply a ascending sort on task ID).
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+
+	// Add the supported sort values for this endpoint to the sort safelist.
+	input.Filters.SortSafelist = []string{"id", "title", "created_at", "-id", "-title", "-created_at"}
+
+	// Execute the validation checks on the Filters struct and send a response
+	// containing the errors if necessary.
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Call the GetAll() method to retrieve the tasks, passing in the various filter
+	// parameters.
+	tasks, metadata, err := app.modelsFor(r).Tasks.GetAll(app.contextGetUser(r).ID, input.Title, input.CreatedBy, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Include the metadata in the response envelope.
+	err = app.writeJSON(w, http.StatusOK, envelope{"tasks": tasks, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
 func (app *application) updateTaskHandler(w http.ResponseWriter, r *http.Request) {
 	// Extract the task ID from the URL
 	id, err := app.readIDparam(r)
@@ -106,8 +195,8 @@ func (app *application) updateTaskHandler(w http.ResponseWriter, r *http.Request
 	}
 
 	// Fetch the existing task record from the database, sending a 404 Not Found
-	// response to the client if we couldn't find a matching record.
-	task, err := app.models.Tasks.Get(id)
+	// response to the client if we couldn't find a matching record owned by them.
+	task, err := app.modelsFor(r).Tasks.Get(id, app.contextGetUser(r).ID)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -151,7 +240,7 @@ func (app *application) updateTaskHandler(w http.ResponseWriter, r *http.Request
 	}
 
 	// pass the updated task record to our Update() method.
-	err = app.models.Tasks.Update(task)
+	err = app.modelsFor(r).Tasks.Update(task)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -178,9 +267,9 @@ func (app *application) deleteTaskHandler(w http.ResponseWriter, r *http.Request
 	}
 
 	// Delete the task from the database, sending a 404 Not Found response to the
-	// client if there isn't a matching record.
+	// client if there isn't a matching record owned by them.
 
-	err = app.models.Tasks.Delete(id)
+	err = app.modelsFor(r).Tasks.Delete(id, app.contextGetUser(r).ID)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
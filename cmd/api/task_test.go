@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/JacobNewton007/sendchamp-go-test/internal/data"
+)
+
+func TestTaskPermissions(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.createUser("reader@example.com", true, "tasks:read")
+	access, _ := ts.login("reader@example.com")
+
+	res := ts.do(http.MethodGet, "/v1/tasks", access, nil)
+	if res.status != http.StatusOK {
+		t.Errorf("listing tasks: got status %d, body %v", res.status, res.body)
+	}
+
+	writes := []struct {
+		method string
+		path   string
+		body   interface{}
+	}{
+		{http.MethodPost, "/v1/tasks", map[string]string{"title": "buy milk", "created_by": "reader"}},
+		{http.MethodPatch, "/v1/tasks/1", map[string]string{"title": "buy oat milk"}},
+		{http.MethodDelete, "/v1/tasks/1", nil},
+	}
+
+	for _, w := range writes {
+		res := ts.do(w.method, w.path, access, w.body)
+		if res.status != http.StatusForbidden || errorCode(res.body) != codeNotPermitted {
+			t.Errorf("%s %s without tasks:write: got status %d, body %v", w.method, w.path, res.status, res.body)
+		}
+	}
+
+	res = ts.do(http.MethodGet, "/v1/tasks", "", nil)
+	if res.status != http.StatusUnauthorized || errorCode(res.body) != codeAuthenticationRequired {
+		t.Errorf("listing tasks anonymously: got status %d, body %v", res.status, res.body)
+	}
+}
+
+func TestTaskOwnerScoping(t *testing.T) {
+	ts := newTestServer(t)
+
+	aliceID := ts.createUser("alice@example.com", true, "tasks:read", "tasks:write")
+	ts.createUser("bob@example.com", true, "tasks:read", "tasks:write")
+
+	alice, _ := ts.login("alice@example.com")
+	bob, _ := ts.login("bob@example.com")
+
+	taskID, err := ts.app.models.Tasks.Insert(&data.Tasks{Title: "buy milk", CreatedBy: "alice", OwnerID: aliceID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	taskPath := fmt.Sprintf("/v1/tasks/%d", taskID)
+
+	res := ts.do(http.MethodGet, taskPath, alice, nil)
+	if res.status != http.StatusOK {
+		t.Errorf("owner fetching task: got status %d, body %v", res.status, res.body)
+	}
+
+	// Another user's tasks look exactly like tasks which don't exist.
+	for _, req := range []struct {
+		method string
+		body   interface{}
+	}{
+		{http.MethodGet, nil},
+		{http.MethodPatch, map[string]string{"title": "buy oat milk"}},
+		{http.MethodDelete, nil},
+	} {
+		res := ts.do(req.method, taskPath, bob, req.body)
+		if res.status != http.StatusNotFound || errorCode(res.body) != codeNotFound {
+			t.Errorf("%s on another user's task: got status %d, body %v", req.method, res.status, res.body)
+		}
+	}
+
+	res = ts.do(http.MethodGet, "/v1/tasks", bob, nil)
+	if tasks, _ := res.body["tasks"].([]interface{}); res.status != http.StatusOK || len(tasks) != 0 {
+		t.Errorf("listing another user's tasks: got status %d, body %v", res.status, res.body)
+	}
+
+	res = ts.do(http.MethodGet, "/v1/tasks", alice, nil)
+	if tasks, _ := res.body["tasks"].([]interface{}); res.status != http.StatusOK || len(tasks) != 1 {
+		t.Errorf("listing own tasks: got status %d, body %v", res.status, res.body)
+	}
+
+	// The same goes for the jobs which create tasks.
+	res = ts.do(http.MethodPost, "/v1/tasks", alice, map[string]string{"title": "buy bread", "created_by": "alice"})
+	if res.status != http.StatusAccepted {
+		t.Fatalf("creating a task: got status %d, body %v", res.status, res.body)
+	}
+
+	jobPath := res.header.Get("Location")
+
+	res = ts.do(http.MethodGet, jobPath, alice, nil)
+	if res.status != http.StatusOK {
+		t.Errorf("owner fetching %s: got status %d, body %v", jobPath, res.status, res.body)
+	}
+
+	res = ts.do(http.MethodGet, jobPath, bob, nil)
+	if res.status != http.StatusNotFound {
+		t.Errorf("fetching another user's job %s: got status %d, body %v", jobPath, res.status, res.body)
+	}
+}
+
+func TestInProcessQueue(t *testing.T) {
+	ts := newTestServer(t)
+	ts.app.inProcessQueue = true
+
+	ts.createUser("alice@example.com", true, "tasks:read", "tasks:write")
+	access, _ := ts.login("alice@example.com")
+
+	res := ts.do(http.MethodPost, "/v1/tasks", access, map[string]string{"title": "buy milk", "created_by": "alice"})
+	if res.status != http.StatusAccepted {
+		t.Fatalf("creating a task: got status %d, body %v", res.status, res.body)
+	}
+
+	jobPath := res.header.Get("Location")
+
+	// Without a broker, the relay processes the task itself.
+	ts.app.relayOutbox(context.Background())
+
+	res = ts.do(http.MethodGet, jobPath, access, nil)
+	job, _ := res.body["job"].(map[string]interface{})
+	if res.status != http.StatusOK || job["status"] != data.JobSucceeded {
+		t.Fatalf("fetching %s after relaying: got status %d, body %v", jobPath, res.status, res.body)
+	}
+
+	res = ts.do(http.MethodGet, fmt.Sprintf("/v1/tasks/%v", job["task_id"]), access, nil)
+	if res.status != http.StatusOK {
+		t.Errorf("fetching the created task: got status %d, body %v", res.status, res.body)
+	}
+}
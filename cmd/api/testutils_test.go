@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/JacobNewton007/sendchamp-go-test/internal/data"
+	"github.com/JacobNewton007/sendchamp-go-test/internal/data/memory"
+	"github.com/JacobNewton007/sendchamp-go-test/internal/jsonlog"
+	"github.com/JacobNewton007/sendchamp-go-test/internal/jwtauth"
+	"github.com/JacobNewton007/sendchamp-go-test/internal/mailer"
+)
+
+// testServer serves the application's routes from the in-memory storage backend, with
+// emails written to a buffer instead of being delivered. Nothing talks to RabbitMQ:
+// creating a task only writes to the outbox, and no relay or worker is started.
+type testServer struct {
+	t       *testing.T
+	app     *application
+	handler http.Handler
+	mail    *bytes.Buffer
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	var cfg config
+	cfg.env = "testing"
+	cfg.auth.mode = "token"
+	cfg.auth.accessTokenTTL = time.Hour
+
+	mail := new(bytes.Buffer)
+
+	app := &application{
+		config:      cfg,
+		logger:      jsonlog.New(io.Discard, jsonlog.LevelOff),
+		models:      memory.New(),
+		metrics:     newMetrics(nil),
+		mailer:      mailer.NewFile(mail, "Sendchamp <no-reply@sendchamp.com>"),
+		outboxNudge: make(chan struct{}, 1),
+	}
+
+	return &testServer{t: t, app: app, handler: app.routes(), mail: mail}
+}
+
+// The useJWT() method switches the server to -auth-mode=jwt, with a single HS256 key.
+func (ts *testServer) useJWT() {
+	ts.t.Helper()
+
+	authority, err := jwtauth.New("HS256", []jwtauth.Key{{ID: "test", Secret: bytes.Repeat([]byte("k"), 32)}}, "test", "test")
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+
+	ts.app.config.auth.mode = "jwt"
+	ts.app.jwt = authority
+}
+
+// response is what the do() method returns: the status code, headers and decoded JSON
+// body of a response.
+type response struct {
+	status int
+	header http.Header
+	body   map[string]interface{}
+}
+
+// The do() method sends a request through the full middleware chain. If body isn't
+// nil it's sent as JSON, and if token isn't empty it's sent as a bearer token.
+func (ts *testServer) do(method, path, token string, body interface{}) response {
+	ts.t.Helper()
+
+	var reqBody io.Reader
+	if body != nil {
+		js, err := json.Marshal(body)
+		if err != nil {
+			ts.t.Fatal(err)
+		}
+		reqBody = bytes.NewReader(js)
+	}
+
+	r := httptest.NewRequest(method, path, reqBody)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rr := httptest.NewRecorder()
+	ts.handler.ServeHTTP(rr, r)
+
+	res := response{status: rr.Code, header: rr.Header()}
+
+	if rr.Body.Len() > 0 {
+		err := json.Unmarshal(rr.Body.Bytes(), &res.body)
+		if err != nil {
+			ts.t.Fatalf("%s %s: decoding response %q: %v", method, path, rr.Body.String(), err)
+		}
+	}
+
+	return res
+}
+
+var mailTokenRX = regexp.MustCompile(`"token": "([A-Z2-7]{26})"`)
+
+// The lastMailedToken() method waits for the emails being sent in the background and
+// returns the token in the most recent one.
+func (ts *testServer) lastMailedToken() string {
+	ts.t.Helper()
+
+	ts.app.wg.Wait()
+
+	matches := mailTokenRX.FindAllStringSubmatch(ts.mail.String(), -1)
+	if len(matches) == 0 {
+		ts.t.Fatalf("no token found in emails:\n%s", ts.mail.String())
+	}
+
+	return matches[len(matches)-1][1]
+}
+
+// The createUser() method adds a user straight to the store, with exactly the given
+// permissions, and returns their ID. The password is always "pa55word1234".
+func (ts *testServer) createUser(email string, activated bool, permissions ...string) int64 {
+	ts.t.Helper()
+
+	user := &data.User{Name: "Test User", Email: email}
+	if activated {
+		user.Activated = 1
+	}
+
+	err := user.Password.Set("pa55word1234")
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+
+	err = ts.app.models.Users.Insert(user)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+
+	if len(permissions) > 0 {
+		err = ts.app.models.Permissions.AddForUser(user.ID, permissions...)
+		if err != nil {
+			ts.t.Fatal(err)
+		}
+	}
+
+	return user.ID
+}
+
+// The login() method authenticates as the user with the given email and returns their
+// access and refresh tokens.
+func (ts *testServer) login(email string) (string, string) {
+	ts.t.Helper()
+
+	res := ts.do(http.MethodPost, "/v1/tokens/authentication", "", map[string]string{
+		"email":    email,
+		"password": "pa55word1234",
+	})
+	if res.status != http.StatusCreated {
+		ts.t.Fatalf("logging in as %s: got status %d, body %v", email, res.status, res.body)
+	}
+
+	return tokenField(ts.t, res.body, "authentication_token"), tokenField(ts.t, res.body, "refresh_token")
+}
+
+// The tokenField() helper returns the plaintext of the token under key in a response
+// body.
+func tokenField(t *testing.T, body map[string]interface{}, key string) string {
+	t.Helper()
+
+	token, _ := body[key].(map[string]interface{})
+	plaintext, _ := token["token"].(string)
+	if plaintext == "" {
+		t.Fatalf("no %s in response %v", key, body)
+	}
+
+	return plaintext
+}
+
+// The errorCode() helper returns the code from an error response body, or "" if it
+// isn't one.
+func errorCode(body map[string]interface{}) string {
+	apiErr, _ := body["error"].(map[string]interface{})
+	code, _ := apiErr["code"].(string)
+	return code
+}
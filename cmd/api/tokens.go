@@ -6,9 +6,15 @@ import (
 	"time"
 
 	"github.com/JacobNewton007/sendchamp-go-test/internal/data"
+	"github.com/JacobNewton007/sendchamp-go-test/internal/jsonlog"
 	"github.com/JacobNewton007/sendchamp-go-test/internal/validator"
 )
 
+// refreshTokenTTL is the lifetime of refresh tokens. The lifetime of access tokens is
+// set with the -access-token-ttl flag. Clients can use their refresh token to get a new
+// access token without re-sending their password, so it can be much shorter.
+const refreshTokenTTL = 30 * 24 * time.Hour
+
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		Email    string `json:"email"`
@@ -31,7 +37,7 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.modelsFor(r).Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -53,13 +59,430 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
-	token, err := app.models.Token.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	// Start a new token family for this login. Every refresh token rotated from it
+	// will share the family, so that it can be revoked as a whole.
+	family, err := data.NewFamily()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, refreshToken, err := app.issueTokenPair(r, user.ID, family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"authentication_token": token, "refresh_token": refreshToken, "message": "authenticated"}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Exchange a refresh token for a new access token and refresh token. Each refresh token
+// can only be used once. Presenting one that has already been used means it has been
+// copied, so the whole token family is revoked and the user has to log in again.
+func (app *application) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.RefreshToken); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	hash := data.HashToken(input.RefreshToken)
+
+	refreshToken, err := app.modelsFor(r).Token.GetByHash(data.ScopeRefresh, hash)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidRefreshTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if refreshToken.Used {
+		app.revokeTokenFamily(w, r, refreshToken.Family)
+		return
+	}
+
+	// Mark the token as used before issuing new ones. If this fails with an edit
+	// conflict then another request used the same token in the meantime, which we
+	// treat as reuse too.
+	err = app.modelsFor(r).Token.MarkUsed(data.ScopeRefresh, hash)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.revokeTokenFamily(w, r, refreshToken.Family)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Revoke the access tokens issued alongside the old refresh token, so that only
+	// the newest pair in the family can be used.
+	err = app.modelsFor(r).Token.DeleteAllForFamily(data.ScopeAuthentication, refreshToken.Family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, newRefreshToken, err := app.issueTokenPair(r, refreshToken.UserID, refreshToken.Family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"authentication_token": token, "refresh_token": newRefreshToken}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The revokeTokenFamily() helper deletes every access and refresh token in a family
+// after a refresh token has been reused, and tells the client to log in again. In JWT
+// mode the access tokens aren't stored, so the ones already issued from the family
+// stay valid until they expire, up to -access-token-ttl later.
+func (app *application) revokeTokenFamily(w http.ResponseWriter, r *http.Request, family []byte) {
+	for _, scope := range []string{data.ScopeAuthentication, data.ScopeRefresh} {
+		err := app.modelsFor(r).Token.DeleteAllForFamily(scope, family)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	app.requestLogger(r).PrintWarn("refresh token reused, token family revoked", jsonlog.Fields{
+		"request_url": r.URL.String(),
+	})
+
+	app.invalidRefreshTokenResponse(w, r)
+}
+
+// The issueTokenPair() helper creates a short-lived access token and a refresh token
+// for the user, both belonging to the given token family.
+func (app *application) issueTokenPair(r *http.Request, userID int64, family []byte) (*data.Token, *data.Token, error) {
+	var token *data.Token
+
+	// In JWT mode, issue a signed access token instead of storing one in the
+	// database. It is returned in exactly the same shape, so clients don't need to
+	// care which mode the server is running in.
+	if app.jwt != nil {
+		signed, expiry, err := app.jwt.Issue(userID, app.config.auth.accessTokenTTL)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		token = &data.Token{Plaintext: signed, Expiry: expiry}
+	} else {
+		var err error
+
+		token, err = app.modelsFor(r).Token.NewForFamily(userID, app.config.auth.accessTokenTTL, data.ScopeAuthentication, family)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	refreshToken, err := app.modelsFor(r).Token.NewForFamily(userID, refreshTokenTTL, data.ScopeRefresh, family)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return token, refreshToken, nil
+}
+
+// Generate a password reset token and send it to the user's email address.
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse and validate the user's email address.
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Every outcome below ends with the same response, so that the endpoint can't be
+	// used to find out which email addresses have accounts.
+	env := envelope{"message": "if an activated account exists for this email address, an email will be sent to it containing password reset instructions"}
+
+	user, err := app.modelsFor(r).Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.writeJSON(w, http.StatusAccepted, env, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Only activated accounts get a reset token. Unactivated accounts are silently
+	// skipped.
+	if user.Activated != 0 {
+		// Create a new password reset token with a 45-minute expiry time.
+		token, err := app.modelsFor(r).Token.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		// Email the user with their password reset token.
+		app.sendEmail(user.Email, "token_password_reset.tmpl", map[string]interface{}{
+			"passwordResetToken": token.Plaintext,
+		})
+	}
+
+	// Send a 202 Accepted response and confirmation message to the client.
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Issue a fresh activation token for a user who has lost theirs, or whose token has
+// expired.
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse and validate the user's email address.
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token, "message": "authenticated"}, nil)
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Every outcome below ends with the same response, so that the endpoint can't be
+	// used to find out which email addresses have accounts.
+	env := envelope{"message": "if an unactivated account exists for this email address, an email will be sent to it containing activation instructions"}
+
+	user, err := app.modelsFor(r).Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.writeJSON(w, http.StatusAccepted, env, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Only unactivated accounts get a new token. Activated accounts are silently
+	// skipped.
+	if user.Activated == 0 {
+		// Delete any previous activation tokens, so that only the newest one works.
+		err = app.modelsFor(r).Token.DeleteAllForUser(data.ScopeActivation, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		token, err := app.modelsFor(r).Token.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		// Email the user with their additional activation token.
+		app.sendEmail(user.Email, "token_activation.tmpl", map[string]interface{}{
+			"activationToken": token.Plaintext,
+		})
+	}
+
+	// Send a 202 Accepted response and confirmation message to the client.
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Revoke the authentication token used to make this request.
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if app.jwt != nil {
+		app.deleteJWTSessionHandler(w, r)
+		return
+	}
+
+	hash := data.HashToken(app.contextGetToken(r))
+
+	token, err := app.modelsFor(r).Token.GetByHash(data.ScopeAuthentication, hash)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Revoke the refresh tokens from the same login too, otherwise the client could
+	// simply use one to get a new access token.
+	if token.Family != nil {
+		err = app.modelsFor(r).Token.DeleteAllForFamily(data.ScopeRefresh, token.Family)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.modelsFor(r).Token.DeleteByHash(data.ScopeAuthentication, hash)
+	if err != nil {
+		switch {
+		// The token may have been revoked by a concurrent request, in which case the
+		// client can no longer use it anyway.
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been logged out"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// In JWT mode access tokens aren't stored, so they can't be revoked. The
+// deleteJWTSessionHandler() method logs the client out by revoking the refresh tokens
+// from its login instead, so that the access token can't be renewed once it expires.
+// JWTs don't say which login they came from, so the client sends its refresh token in
+// the body. If it doesn't, every refresh token belonging to the user is revoked.
+func (app *application) deleteJWTSessionHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	if r.ContentLength != 0 {
+		err := app.readJSON(w, r, &input)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+	}
+
+	if input.RefreshToken == "" {
+		err := app.modelsFor(r).Token.DeleteAllForUser(data.ScopeRefresh, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	} else {
+		v := validator.New()
+
+		if data.ValidateTokenPlaintext(v, input.RefreshToken); !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		// A refresh token belonging to someone else is treated like one which doesn't
+		// exist, so that it can't be used to log another user out.
+		refreshToken, err := app.modelsFor(r).Token.GetByHash(data.ScopeRefresh, data.HashToken(input.RefreshToken))
+		if err == nil && refreshToken.UserID != user.ID {
+			err = data.ErrRecordNotFound
+		}
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.invalidRefreshTokenResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		err = app.modelsFor(r).Token.DeleteAllForFamily(data.ScopeRefresh, refreshToken.Family)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	message := "you have been logged out, but your access token remains valid until it expires"
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"message": message}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Revoke every authentication token belonging to the current user, signing them out of
+// all their sessions.
+func (app *application) deleteAllAuthenticationTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	// In JWT mode there are no stored access tokens, so only the refresh tokens are
+	// revoked. The access tokens already issued stay valid until they expire.
+	if app.jwt != nil {
+		err := app.modelsFor(r).Token.DeleteAllForUser(data.ScopeRefresh, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		message := "all of your sessions have been logged out, but access tokens already issued remain valid until they expire"
+
+		err = app.writeJSON(w, http.StatusOK, envelope{"message": message}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	for _, scope := range []string{data.ScopeAuthentication, data.ScopeRefresh} {
+		err := app.modelsFor(r).Token.DeleteAllForUser(scope, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"message": "all of your sessions have been logged out"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
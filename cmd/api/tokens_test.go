@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRefreshTokenReuse(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.createUser("alice@example.com", true, "tasks:read")
+	access, refresh := ts.login("alice@example.com")
+
+	res := ts.do(http.MethodPost, "/v1/tokens/refresh", "", map[string]string{"refresh_token": refresh})
+	if res.status != http.StatusCreated {
+		t.Fatalf("refreshing: got status %d, body %v", res.status, res.body)
+	}
+
+	newAccess := tokenField(t, res.body, "authentication_token")
+	newRefresh := tokenField(t, res.body, "refresh_token")
+
+	// Refreshing revokes the old access token, and the new one works.
+	res = ts.do(http.MethodGet, "/v1/tasks", access, nil)
+	if res.status != http.StatusUnauthorized || errorCode(res.body) != codeInvalidToken {
+		t.Errorf("using the old access token: got status %d, body %v", res.status, res.body)
+	}
+
+	res = ts.do(http.MethodGet, "/v1/tasks", newAccess, nil)
+	if res.status != http.StatusOK {
+		t.Errorf("using the new access token: got status %d, body %v", res.status, res.body)
+	}
+
+	// Presenting the used refresh token again means it has been copied, so it's
+	// rejected and the whole family is revoked.
+	res = ts.do(http.MethodPost, "/v1/tokens/refresh", "", map[string]string{"refresh_token": refresh})
+	if res.status != http.StatusUnauthorized || errorCode(res.body) != codeInvalidRefreshToken {
+		t.Errorf("reusing a refresh token: got status %d, body %v", res.status, res.body)
+	}
+
+	res = ts.do(http.MethodPost, "/v1/tokens/refresh", "", map[string]string{"refresh_token": newRefresh})
+	if res.status != http.StatusUnauthorized || errorCode(res.body) != codeInvalidRefreshToken {
+		t.Errorf("refreshing after reuse: got status %d, body %v", res.status, res.body)
+	}
+
+	res = ts.do(http.MethodGet, "/v1/tasks", newAccess, nil)
+	if res.status != http.StatusUnauthorized || errorCode(res.body) != codeInvalidToken {
+		t.Errorf("using the access token after reuse: got status %d, body %v", res.status, res.body)
+	}
+
+	// Other logins aren't affected.
+	other, _ := ts.login("alice@example.com")
+
+	res = ts.do(http.MethodGet, "/v1/tasks", other, nil)
+	if res.status != http.StatusOK {
+		t.Errorf("using a token from a new login: got status %d, body %v", res.status, res.body)
+	}
+}
+
+func TestJWTLogout(t *testing.T) {
+	ts := newTestServer(t)
+	ts.useJWT()
+
+	ts.createUser("alice@example.com", true, "tasks:read")
+	ts.createUser("bob@example.com", true, "tasks:read")
+
+	access, refresh := ts.login("alice@example.com")
+	_, otherRefresh := ts.login("alice@example.com")
+	bobAccess, bobRefresh := ts.login("bob@example.com")
+
+	refreshWith := func(refresh string) int {
+		t.Helper()
+		return ts.do(http.MethodPost, "/v1/tokens/refresh", "", map[string]string{"refresh_token": refresh}).status
+	}
+
+	// Someone else's refresh token can't be used to log them out.
+	res := ts.do(http.MethodDelete, "/v1/tokens/authentication", access, map[string]string{"refresh_token": bobRefresh})
+	if res.status != http.StatusUnauthorized || errorCode(res.body) != codeInvalidRefreshToken {
+		t.Errorf("logging out with another user's refresh token: got status %d, body %v", res.status, res.body)
+	}
+
+	// Logging out with a refresh token only revokes that login.
+	res = ts.do(http.MethodDelete, "/v1/tokens/authentication", access, map[string]string{"refresh_token": refresh})
+	if message, _ := res.body["message"].(string); res.status != http.StatusOK || message == "" {
+		t.Errorf("logging out: got status %d, body %v", res.status, res.body)
+	}
+
+	if status := refreshWith(refresh); status != http.StatusUnauthorized {
+		t.Errorf("refreshing after logout: got status %d", status)
+	}
+
+	// The JWT can't be revoked, so it keeps working until it expires.
+	res = ts.do(http.MethodGet, "/v1/tasks", access, nil)
+	if res.status != http.StatusOK {
+		t.Errorf("using the access token after logout: got status %d, body %v", res.status, res.body)
+	}
+
+	res = ts.do(http.MethodPost, "/v1/tokens/refresh", "", map[string]string{"refresh_token": otherRefresh})
+	if res.status != http.StatusCreated {
+		t.Fatalf("refreshing another login after logout: got status %d, body %v", res.status, res.body)
+	}
+	otherRefresh = tokenField(t, res.body, "refresh_token")
+
+	// Logging out without a refresh token revokes all of the user's logins.
+	res = ts.do(http.MethodDelete, "/v1/tokens/authentication", access, nil)
+	if res.status != http.StatusOK {
+		t.Errorf("logging out without a refresh token: got status %d, body %v", res.status, res.body)
+	}
+
+	if status := refreshWith(otherRefresh); status != http.StatusUnauthorized {
+		t.Errorf("refreshing after logging out without a refresh token: got status %d", status)
+	}
+
+	// Logging out everywhere revokes all of the user's refresh tokens, and nobody
+	// else's.
+	_, refresh = ts.login("alice@example.com")
+
+	res = ts.do(http.MethodDelete, "/v1/tokens/authentication/all", access, nil)
+	if message, _ := res.body["message"].(string); res.status != http.StatusOK || message == "" {
+		t.Errorf("logging out everywhere: got status %d, body %v", res.status, res.body)
+	}
+
+	if status := refreshWith(refresh); status != http.StatusUnauthorized {
+		t.Errorf("refreshing after logging out everywhere: got status %d", status)
+	}
+
+	if status := refreshWith(bobRefresh); status != http.StatusCreated {
+		t.Errorf("another user refreshing: got status %d", status)
+	}
+
+	res = ts.do(http.MethodGet, "/v1/tasks", bobAccess, nil)
+	if res.status != http.StatusOK {
+		t.Errorf("another user's access token: got status %d, body %v", res.status, res.body)
+	}
+}
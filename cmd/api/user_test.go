@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRegisterAndActivateUser(t *testing.T) {
+	ts := newTestServer(t)
+
+	res := ts.do(http.MethodPost, "/v1/users", "", map[string]string{
+		"name":     "Alice",
+		"email":    "alice@example.com",
+		"password": "pa55word1234",
+	})
+	if res.status != http.StatusAccepted {
+		t.Fatalf("registering: got status %d, body %v", res.status, res.body)
+	}
+
+	user, _ := res.body["user"].(map[string]interface{})
+	if user["email"] != "alice@example.com" || user["activated"] != float64(0) {
+		t.Errorf("registering: got user %v", user)
+	}
+
+	// The activation token is only sent by email, never in the response.
+	token := ts.lastMailedToken()
+
+	// Registering the same email address again fails validation.
+	res = ts.do(http.MethodPost, "/v1/users", "", map[string]string{
+		"name":     "Another Alice",
+		"email":    "alice@example.com",
+		"password": "pa55word1234",
+	})
+	if res.status != http.StatusUnprocessableEntity || errorCode(res.body) != codeValidationFailed {
+		t.Errorf("registering a duplicate: got status %d, body %v", res.status, res.body)
+	}
+
+	// Until the account is activated, the user can log in but not use the tasks API.
+	access, _ := ts.login("alice@example.com")
+
+	res = ts.do(http.MethodGet, "/v1/tasks", access, nil)
+	if res.status != http.StatusForbidden || errorCode(res.body) != codeInactiveAccount {
+		t.Errorf("listing tasks before activation: got status %d, body %v", res.status, res.body)
+	}
+
+	res = ts.do(http.MethodPut, "/v1/users/activated", "", map[string]string{"token": "AAAAAAAAAAAAAAAAAAAAAAAAAA"})
+	if res.status != http.StatusUnprocessableEntity || errorCode(res.body) != codeValidationFailed {
+		t.Errorf("activating with the wrong token: got status %d, body %v", res.status, res.body)
+	}
+
+	res = ts.do(http.MethodPut, "/v1/users/activated", "", map[string]string{"token": token})
+	if res.status != http.StatusOK {
+		t.Fatalf("activating: got status %d, body %v", res.status, res.body)
+	}
+
+	user, _ = res.body["user"].(map[string]interface{})
+	if user["activated"] != float64(1) {
+		t.Errorf("activating: got user %v", user)
+	}
+
+	// The token can only be used once.
+	res = ts.do(http.MethodPut, "/v1/users/activated", "", map[string]string{"token": token})
+	if res.status != http.StatusUnprocessableEntity {
+		t.Errorf("activating twice: got status %d, body %v", res.status, res.body)
+	}
+
+	// Once activated, the user can read and write tasks.
+	res = ts.do(http.MethodGet, "/v1/tasks", access, nil)
+	if res.status != http.StatusOK {
+		t.Errorf("listing tasks after activation: got status %d, body %v", res.status, res.body)
+	}
+
+	res = ts.do(http.MethodPost, "/v1/tasks", access, map[string]string{"title": "buy milk", "created_by": "alice"})
+	if res.status != http.StatusAccepted {
+		t.Errorf("creating a task after activation: got status %d, body %v", res.status, res.body)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/JacobNewton007/sendchamp-go-test/internal/data"
+	"github.com/JacobNewton007/sendchamp-go-test/internal/jsonlog"
+	"github.com/JacobNewton007/sendchamp-go-test/internal/rabbitmq"
+	"github.com/JacobNewton007/sendchamp-go-test/internal/validator"
+)
+
+// The startTaskWorker() helper launches the long-running RabbitMQ consumer in a
+// background goroutine. The consumer runs until ctx is cancelled, and because it is
+// tracked by app.wg the graceful shutdown in server() waits for the in-flight delivery
+// to be acknowledged or requeued before exiting.
+func (app *application) startTaskWorker(ctx context.Context) {
+	// Without a broker the outbox relay hands tasks to processTask() itself, so
+	// there's nothing to consume.
+	if app.inProcessQueue {
+		return
+	}
+
+	app.background(func() {
+		app.logger.PrintInfo("starting task worker", nil)
+
+		err := app.rMq.Worker(ctx, app.processTask)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		app.logger.PrintInfo("stopped task worker", nil)
+	})
+}
+
+// The processTask() method validates a task consumed from the queue, inserts it into
+// the database and records the outcome against the job that was created for it. A job
+// which has already succeeded is never moved to another status, so a duplicate of the
+// message is acknowledged without doing anything.
+func (app *application) processTask(ctx context.Context, input rabbitmq.AddTask) error {
+	models := app.models.Traced(ctx)
+
+	// Everything logged about this task carries the job ID, and the ID of the request
+	// which created it if there was one.
+	logger := app.logger.With(jsonlog.Fields{"job_id": input.JobID})
+	if input.RequestID != "" {
+		logger = logger.With(jsonlog.Fields{"request_id": input.RequestID})
+	}
+
+	job, err := models.Jobs.Get(input.JobID, input.OwnerID)
+	if err != nil {
+		// A message whose job no longer exists can never be reported on, so there's
+		// no point in requeueing it.
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return fmt.Errorf("%w: job %d not found", rabbitmq.ErrInvalidTask, input.JobID)
+		}
+		return err
+	}
+
+	// The outbox relay delivers messages at least once, so the same task can arrive
+	// twice. If the job has already succeeded, the task was created the first time.
+	if job.Status == data.JobSucceeded {
+		logger.PrintInfo("ignored duplicate task", jsonlog.Fields{
+			"task_id": job.TaskID,
+		})
+		return nil
+	}
+
+	err = models.Jobs.UpdateStatus(input.JobID, data.JobProcessing, 0, "")
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return fmt.Errorf("%w: job %d not found", rabbitmq.ErrInvalidTask, input.JobID)
+		case errors.Is(err, data.ErrJobCompleted):
+			logger.PrintInfo("ignored duplicate task", nil)
+			return nil
+		default:
+			return err
+		}
+	}
+
+	task := &data.Tasks{
+		Title:     input.Title,
+		CreatedBy: input.CreatedBy,
+		OwnerID:   input.OwnerID,
+	}
+
+	v := validator.New()
+
+	if data.ValidateTask(v, task); !v.Valid() {
+		errText := fmt.Sprintf("%v", v.Errors)
+
+		err := models.Jobs.UpdateStatus(input.JobID, data.JobFailed, 0, errText)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: %s", rabbitmq.ErrInvalidTask, errText)
+	}
+
+	// The task is inserted and the job marked as succeeded in one transaction, so if
+	// a duplicate of this message is being processed at the same time only one of
+	// them creates the task.
+	id, err := models.Tasks.InsertForJob(task, input.JobID)
+	if err != nil {
+		if errors.Is(err, data.ErrJobCompleted) {
+			logger.PrintInfo("ignored duplicate task", nil)
+			return nil
+		}
+
+		// The message is going to be retried, so put the job back to pending rather
+		// than leaving it stuck in processing, unless this was the last attempt. The
+		// original error is the one worth returning, so a failure to update the job
+		// is only logged.
+		status := data.JobPending
+		if input.FinalAttempt {
+			status = data.JobFailed
+		}
+
+		if jobErr := models.Jobs.UpdateStatus(input.JobID, status, 0, err.Error()); jobErr != nil {
+			logger.PrintError(jobErr, nil)
+		}
+		return err
+	}
+
+	logger.PrintInfo("task created", jsonlog.Fields{
+		"task_id": id,
+	})
+
+	return nil
+}
@@ -0,0 +1,536 @@
+// Package datatest implements a conformance suite for storage backends. Every backend
+// registered with the data package must pass it, so that the application behaves the
+// same whichever one it runs against.
+package datatest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/JacobNewton007/sendchamp-go-test/internal/data"
+)
+
+// TestModels checks that models behave like the reference MySQL implementation:
+// which errors are returned for missing records, edit conflicts and duplicate emails,
+// how tokens expire, and how tasks are scoped to their owner. It expects models to be
+// backed by an empty database with the migrations applied, and returns an error
+// describing every check which failed. Like testing/fstest.TestFS, it can be called
+// from a test or from any other program.
+func TestModels(models data.Models) error {
+	c := &checker{m: models}
+
+	for _, check := range []struct {
+		name string
+		fn   func()
+	}{
+		{"users", c.users},
+		{"tokens", c.tokens},
+		{"permissions", c.permissions},
+		{"tasks", c.tasks},
+		{"jobs", c.jobs},
+		{"outbox", c.outbox},
+	} {
+		c.section = check.name
+		check.fn()
+	}
+
+	if len(c.failures) > 0 {
+		msgs := make([]string, len(c.failures))
+		for i, err := range c.failures {
+			msgs[i] = err.Error()
+		}
+		return fmt.Errorf("%d conformance checks failed:\n%s", len(msgs), strings.Join(msgs, "\n"))
+	}
+
+	return nil
+}
+
+type checker struct {
+	m        data.Models
+	section  string
+	failures []error
+
+	// user is created by the users checks and reused by the rest.
+	user *data.User
+}
+
+// The errorf() method records a failed check.
+func (c *checker) errorf(format string, args ...interface{}) {
+	c.failures = append(c.failures, fmt.Errorf(c.section+": "+format, args...))
+}
+
+// The expect() method records a failure unless err matches target. A nil target
+// means no error is expected.
+func (c *checker) expect(what string, err, target error) {
+	switch {
+	case target == nil && err != nil:
+		c.errorf("%s: unexpected error: %v", what, err)
+	case target != nil && !errors.Is(err, target):
+		c.errorf("%s: got error %v, want %v", what, err, target)
+	}
+}
+
+func (c *checker) users() {
+	user := &data.User{Name: "Alice", Email: "Alice@Example.com"}
+	if err := user.Password.Set("pa55word1234"); err != nil {
+		c.errorf("setting password: %v", err)
+		return
+	}
+
+	err := c.m.Users.Insert(user)
+	c.expect("Insert", err, nil)
+	if err != nil {
+		return
+	}
+	if user.ID < 1 {
+		c.errorf("Insert did not set the user ID")
+	}
+	c.user = user
+
+	dup := &data.User{Name: "Bob", Email: "alice@EXAMPLE.com"}
+	_ = dup.Password.Set("pa55word1234")
+	c.expect("Insert with duplicate email", c.m.Users.Insert(dup), data.ErrDuplicateEmail)
+
+	got, err := c.m.Users.GetByEmail("ALICE@example.com")
+	c.expect("GetByEmail", err, nil)
+	if err == nil {
+		if got.ID != user.ID || got.Name != "Alice" || got.Email != "alice@example.com" {
+			c.errorf("GetByEmail returned %+v", got)
+		}
+		if ok, _ := got.Password.Matches("pa55word1234"); !ok {
+			c.errorf("GetByEmail did not return the password hash")
+		}
+	}
+
+	_, err = c.m.Users.GetByEmail("nobody@example.com")
+	c.expect("GetByEmail for unknown email", err, data.ErrRecordNotFound)
+
+	_, err = c.m.Users.Get(user.ID + 1000)
+	c.expect("Get for unknown ID", err, data.ErrRecordNotFound)
+
+	got, err = c.m.Users.Get(user.ID)
+	c.expect("Get", err, nil)
+	if err != nil {
+		return
+	}
+
+	version := got.Version
+	got.Activated = 1
+	c.expect("Update", c.m.Users.Update(got), nil)
+	if got.Version != version+1 {
+		c.errorf("Update set version %d, want %d", got.Version, version+1)
+	}
+
+	stale := *got
+	stale.Version = version
+	c.expect("Update with stale version", c.m.Users.Update(&stale), data.ErrEditConflict)
+
+	other := &data.User{Name: "Carol", Email: "carol@example.com"}
+	_ = other.Password.Set("pa55word1234")
+	c.expect("Insert second user", c.m.Users.Insert(other), nil)
+	if other, err := c.m.Users.Get(other.ID); err == nil {
+		other.Email = "alice@example.com"
+		c.expect("Update with duplicate email", c.m.Users.Update(other), data.ErrDuplicateEmail)
+	}
+
+	got, err = c.m.Users.Get(user.ID)
+	c.expect("Get after Update", err, nil)
+	if err == nil && got.Activated != 1 {
+		c.errorf("Update did not persist the activated flag")
+	}
+
+	c.register()
+}
+
+// The register() method checks that Register saves the user, their permissions and
+// their token together, and saves none of them if the email address is taken.
+func (c *checker) register() {
+	user := &data.User{Name: "Dave", Email: "dave@example.com"}
+	_ = user.Password.Set("pa55word1234")
+
+	token, err := data.GenerateToken(0, time.Hour, data.ScopeActivation)
+	c.expect("GenerateToken", err, nil)
+	if err != nil {
+		return
+	}
+
+	err = c.m.Users.Register(user, token, "tasks:read")
+	c.expect("Register", err, nil)
+	if err != nil {
+		return
+	}
+	if user.ID < 1 || token.UserID != user.ID {
+		c.errorf("Register set user ID %d and token user ID %d", user.ID, token.UserID)
+	}
+
+	got, err := c.m.Users.GetForToken(data.ScopeActivation, token.Plaintext)
+	c.expect("GetForToken after Register", err, nil)
+	if err == nil && got.ID != user.ID {
+		c.errorf("GetForToken after Register returned user %d, want %d", got.ID, user.ID)
+	}
+
+	permissions, err := c.m.Permissions.GetAllForUser(user.ID)
+	c.expect("GetAllForUser after Register", err, nil)
+	if len(permissions) != 1 || !permissions.Include("tasks:read") {
+		c.errorf("GetAllForUser after Register returned %v", permissions)
+	}
+
+	dup := &data.User{Name: "Dave", Email: "DAVE@example.com"}
+	_ = dup.Password.Set("pa55word1234")
+
+	dupToken, err := data.GenerateToken(0, time.Hour, data.ScopeActivation)
+	c.expect("GenerateToken", err, nil)
+	if err != nil {
+		return
+	}
+
+	c.expect("Register with duplicate email", c.m.Users.Register(dup, dupToken, "tasks:read"), data.ErrDuplicateEmail)
+
+	_, err = c.m.Token.GetByHash(data.ScopeActivation, dupToken.Hash)
+	c.expect("GetByHash after failed Register", err, data.ErrRecordNotFound)
+}
+
+func (c *checker) tokens() {
+	if c.user == nil {
+		c.errorf("skipped, no user")
+		return
+	}
+
+	token, err := c.m.Token.New(c.user.ID, time.Hour, data.ScopeAuthentication)
+	c.expect("New", err, nil)
+	if err != nil {
+		return
+	}
+
+	user, err := c.m.Users.GetForToken(data.ScopeAuthentication, token.Plaintext)
+	c.expect("GetForToken", err, nil)
+	if err == nil && user.ID != c.user.ID {
+		c.errorf("GetForToken returned user %d, want %d", user.ID, c.user.ID)
+	}
+
+	_, err = c.m.Users.GetForToken(data.ScopeActivation, token.Plaintext)
+	c.expect("GetForToken with wrong scope", err, data.ErrRecordNotFound)
+
+	expired, err := c.m.Token.New(c.user.ID, -time.Hour, data.ScopeAuthentication)
+	c.expect("New expired", err, nil)
+	if err == nil {
+		_, err = c.m.Users.GetForToken(data.ScopeAuthentication, expired.Plaintext)
+		c.expect("GetForToken for expired token", err, data.ErrRecordNotFound)
+
+		_, err = c.m.Token.GetByHash(data.ScopeAuthentication, expired.Hash)
+		c.expect("GetByHash for expired token", err, data.ErrRecordNotFound)
+	}
+
+	c.expect("DeleteByHash", c.m.Token.DeleteByHash(data.ScopeAuthentication, token.Hash), nil)
+	c.expect("DeleteByHash twice", c.m.Token.DeleteByHash(data.ScopeAuthentication, token.Hash), data.ErrRecordNotFound)
+
+	family, err := data.NewFamily()
+	c.expect("NewFamily", err, nil)
+
+	refresh, err := c.m.Token.NewForFamily(c.user.ID, time.Hour, data.ScopeRefresh, family)
+	c.expect("NewForFamily", err, nil)
+	if err != nil {
+		return
+	}
+
+	c.expect("MarkUsed", c.m.Token.MarkUsed(data.ScopeRefresh, refresh.Hash), nil)
+	c.expect("MarkUsed twice", c.m.Token.MarkUsed(data.ScopeRefresh, refresh.Hash), data.ErrEditConflict)
+
+	got, err := c.m.Token.GetByHash(data.ScopeRefresh, refresh.Hash)
+	c.expect("GetByHash", err, nil)
+	if err == nil && (!got.Used || got.UserID != c.user.ID || string(got.Family) != string(family)) {
+		c.errorf("GetByHash returned %+v", got)
+	}
+
+	c.expect("DeleteAllForFamily", c.m.Token.DeleteAllForFamily(data.ScopeRefresh, family), nil)
+	_, err = c.m.Token.GetByHash(data.ScopeRefresh, refresh.Hash)
+	c.expect("GetByHash after DeleteAllForFamily", err, data.ErrRecordNotFound)
+
+	// Tokens without a family must survive a family delete with a nil family.
+	lone, err := c.m.Token.New(c.user.ID, time.Hour, data.ScopeRefresh)
+	c.expect("New without family", err, nil)
+	c.expect("DeleteAllForFamily with nil family", c.m.Token.DeleteAllForFamily(data.ScopeRefresh, nil), nil)
+	if err == nil {
+		_, err = c.m.Token.GetByHash(data.ScopeRefresh, lone.Hash)
+		c.expect("GetByHash after nil family delete", err, nil)
+	}
+
+	c.expect("DeleteAllForUser", c.m.Token.DeleteAllForUser(data.ScopeRefresh, c.user.ID), nil)
+	if err == nil {
+		_, err = c.m.Token.GetByHash(data.ScopeRefresh, lone.Hash)
+		c.expect("GetByHash after DeleteAllForUser", err, data.ErrRecordNotFound)
+	}
+}
+
+func (c *checker) permissions() {
+	if c.user == nil {
+		c.errorf("skipped, no user")
+		return
+	}
+
+	permissions, err := c.m.Permissions.GetAllForUser(c.user.ID)
+	c.expect("GetAllForUser", err, nil)
+	if len(permissions) != 0 {
+		c.errorf("new user has permissions %v", permissions)
+	}
+
+	c.expect("AddForUser", c.m.Permissions.AddForUser(c.user.ID, "tasks:read"), nil)
+	c.expect("AddForUser again", c.m.Permissions.AddForUser(c.user.ID, "tasks:read", "tasks:write", "unknown:code"), nil)
+
+	permissions, err = c.m.Permissions.GetAllForUser(c.user.ID)
+	c.expect("GetAllForUser", err, nil)
+	if len(permissions) != 2 || !permissions.Include("tasks:read") || !permissions.Include("tasks:write") {
+		c.errorf("GetAllForUser returned %v", permissions)
+	}
+}
+
+func (c *checker) tasks() {
+	if c.user == nil {
+		c.errorf("skipped, no user")
+		return
+	}
+
+	owner, stranger := c.user.ID, c.user.ID+1000
+
+	for _, title := range []string{"buy milk", "walk the dog", "milk the cow"} {
+		_, err := c.m.Tasks.Insert(&data.Tasks{Title: title, CreatedBy: "alice", OwnerID: owner})
+		c.expect("Insert", err, nil)
+	}
+
+	filters := data.Filters{
+		Page:         1,
+		PageSize:     1,
+		Sort:         "-title",
+		SortSafelist: []string{"id", "title", "-title"},
+	}
+
+	tasks, metadata, err := c.m.Tasks.GetAll(owner, "milk", "", filters)
+	c.expect("GetAll", err, nil)
+	want := data.Metadata{CurrentPage: 1, PageSize: 1, FirstPage: 1, LastPage: 2, TotalRecords: 2}
+	if metadata != want {
+		c.errorf("GetAll returned metadata %+v, want %+v", metadata, want)
+	}
+	if len(tasks) != 1 || tasks[0].Title != "milk the cow" {
+		c.errorf("GetAll did not return the first task in descending title order")
+		return
+	}
+
+	filters.Sort, filters.PageSize = "id", 10
+	tasks, _, err = c.m.Tasks.GetAll(owner, "", "nobody", filters)
+	c.expect("GetAll filtered by created_by", err, nil)
+	if len(tasks) != 0 {
+		c.errorf("GetAll ignored the created_by filter")
+	}
+
+	tasks, metadata, err = c.m.Tasks.GetAll(stranger, "", "", filters)
+	c.expect("GetAll for another owner", err, nil)
+	if len(tasks) != 0 || metadata != (data.Metadata{}) {
+		c.errorf("GetAll returned tasks belonging to another owner")
+	}
+
+	id := tasksID(c.m, owner)
+
+	_, err = c.m.Tasks.Get(id, stranger)
+	c.expect("Get by another owner", err, data.ErrRecordNotFound)
+
+	task, err := c.m.Tasks.Get(id, owner)
+	c.expect("Get", err, nil)
+	if err != nil {
+		return
+	}
+	if task.Version != 1 || task.CreatedAt.IsZero() {
+		c.errorf("Get returned %+v", task)
+	}
+
+	task.Title = "buy oat milk"
+	c.expect("Update", c.m.Tasks.Update(task), nil)
+	if task.Version != 2 {
+		c.errorf("Update set version %d, want 2", task.Version)
+	}
+
+	stale := *task
+	stale.Version = 1
+	c.expect("Update with stale version", c.m.Tasks.Update(&stale), data.ErrEditConflict)
+
+	foreign := *task
+	foreign.OwnerID = stranger
+	c.expect("Update by another owner", c.m.Tasks.Update(&foreign), data.ErrEditConflict)
+
+	c.expect("Delete by another owner", c.m.Tasks.Delete(id, stranger), data.ErrRecordNotFound)
+	c.expect("Delete", c.m.Tasks.Delete(id, owner), nil)
+	c.expect("Delete twice", c.m.Tasks.Delete(id, owner), data.ErrRecordNotFound)
+	c.expect("Delete with invalid ID", c.m.Tasks.Delete(0, owner), data.ErrRecordNotFound)
+}
+
+// The tasksID() helper returns the ID of the owner's first task, or 0 if there is
+// none.
+func tasksID(m data.Models, ownerID int64) int64 {
+	filters := data.Filters{Page: 1, PageSize: 1, Sort: "id", SortSafelist: []string{"id"}}
+
+	tasks, _, err := m.Tasks.GetAll(ownerID, "", "", filters)
+	if err != nil || len(tasks) == 0 {
+		return 0
+	}
+
+	return tasks[0].ID
+}
+
+func (c *checker) jobs() {
+	if c.user == nil {
+		c.errorf("skipped, no user")
+		return
+	}
+
+	job := &data.Job{UserID: c.user.ID}
+	c.expect("Insert", c.m.Jobs.Insert(job, nil), nil)
+	if job.ID < 1 || job.Status != data.JobPending {
+		c.errorf("Insert returned %+v", job)
+	}
+
+	queued := &data.Job{UserID: c.user.ID}
+	err := c.m.Jobs.Insert(queued, func(job *data.Job) (*data.OutboxMessage, error) {
+		if job.ID < 1 {
+			c.errorf("Insert passed a job without an ID to message")
+		}
+
+		return &data.OutboxMessage{
+			AggregateType: data.AggregateJob,
+			AggregateID:   job.ID,
+			Topic:         "add",
+			Payload:       []byte(`{"job_id":1}`),
+			Headers:       data.OutboxHeaders{"X-Request-Id": "abc"},
+		}, nil
+	})
+	c.expect("Insert with message", err, nil)
+
+	errMessage := errors.New("no message")
+	err = c.m.Jobs.Insert(&data.Job{UserID: c.user.ID}, func(*data.Job) (*data.OutboxMessage, error) {
+		return nil, errMessage
+	})
+	c.expect("Insert with failing message", err, errMessage)
+
+	c.expect("UpdateStatus", c.m.Jobs.UpdateStatus(job.ID, data.JobSucceeded, 42, ""), nil)
+	c.expect("UpdateStatus for unknown job", c.m.Jobs.UpdateStatus(job.ID+1000, data.JobFailed, 0, "boom"), data.ErrRecordNotFound)
+	c.expect("UpdateStatus for succeeded job", c.m.Jobs.UpdateStatus(job.ID, data.JobProcessing, 0, ""), data.ErrJobCompleted)
+
+	got, err := c.m.Jobs.Get(job.ID, c.user.ID)
+	c.expect("Get", err, nil)
+	if err == nil && (got.Status != data.JobSucceeded || got.TaskID != 42 || got.Error != "") {
+		c.errorf("Get returned %+v", got)
+	}
+
+	_, err = c.m.Jobs.Get(job.ID, c.user.ID+1000)
+	c.expect("Get by another user", err, data.ErrRecordNotFound)
+
+	// Completing a job with a task must happen at most once. A second attempt must
+	// leave neither a task nor an event behind, which the outbox checks rely on.
+	task := &data.Tasks{Title: "from a job", CreatedBy: "alice", OwnerID: c.user.ID}
+
+	id, err := c.m.Tasks.InsertForJob(task, queued.ID)
+	c.expect("Tasks.InsertForJob", err, nil)
+
+	_, err = c.m.Tasks.InsertForJob(task, queued.ID)
+	c.expect("Tasks.InsertForJob for completed job", err, data.ErrJobCompleted)
+
+	_, err = c.m.Tasks.InsertForJob(task, queued.ID+1000)
+	c.expect("Tasks.InsertForJob for unknown job", err, data.ErrRecordNotFound)
+
+	got, err = c.m.Jobs.Get(queued.ID, c.user.ID)
+	c.expect("Get after Tasks.InsertForJob", err, nil)
+	if err == nil && (got.Status != data.JobSucceeded || got.TaskID != id) {
+		c.errorf("Get after Tasks.InsertForJob returned %+v, want task %d", got, id)
+	}
+}
+
+// The outbox checks expect the messages written by the tasks and jobs checks: a
+// task.created event for each of the three tasks, then a task.updated and a
+// task.deleted event for the first one, then the job's message and the task.created
+// event for the task inserted for it.
+func (c *checker) outbox() {
+	if c.user == nil {
+		c.errorf("skipped, no user")
+		return
+	}
+
+	var first *data.OutboxMessage
+	var published []*data.OutboxMessage
+
+	// Fail the first message. The rest of the messages for the same task must be held
+	// back, so that they aren't published ahead of it, but the others are sent.
+	sent, err := c.m.Outbox.Relay(100, func(msg *data.OutboxMessage) error {
+		if first == nil {
+			first = msg
+			return errors.New("broker unavailable")
+		}
+		if msg.AggregateType == first.AggregateType && msg.AggregateID == first.AggregateID {
+			c.errorf("Relay published message %d after an earlier message for the same aggregate failed", msg.ID)
+		}
+		published = append(published, msg)
+		return nil
+	})
+	c.expect("Relay with failing publish", err, nil)
+	if first == nil || first.Topic != data.TopicTaskCreated {
+		c.errorf("Relay did not start with a task.created message")
+		return
+	}
+	if sent != 4 || sent != len(published) {
+		c.errorf("Relay with failing publish sent %d messages, want 4", sent)
+	}
+
+	var retried []*data.OutboxMessage
+	sent, err = c.m.Outbox.Relay(100, func(msg *data.OutboxMessage) error {
+		retried = append(retried, msg)
+		return nil
+	})
+	c.expect("Relay", err, nil)
+	if sent != 3 {
+		c.errorf("Relay sent %d messages, want the 3 held back", sent)
+	}
+
+	var topics []string
+	for _, msg := range retried {
+		if msg.AggregateID != first.AggregateID {
+			c.errorf("Relay sent message %d for another aggregate", msg.ID)
+		}
+		topics = append(topics, msg.Topic)
+	}
+	if want := "task.created task.updated task.deleted"; strings.Join(topics, " ") != want {
+		c.errorf("Relay sent %q for the first task, want %q", strings.Join(topics, " "), want)
+	}
+
+	var event data.TaskEvent
+	if len(retried) > 1 {
+		if err := json.Unmarshal(retried[1].Payload, &event); err != nil {
+			c.errorf("decoding task.updated payload: %v", err)
+		} else if event.TaskID != first.AggregateID || event.Title != "buy oat milk" || event.Version != 2 {
+			c.errorf("task.updated payload is %+v", event)
+		}
+	}
+
+	var job *data.OutboxMessage
+	for _, msg := range published {
+		if msg.AggregateType == data.AggregateJob {
+			job = msg
+		}
+	}
+	switch {
+	case job == nil:
+		c.errorf("Relay did not send the job's message")
+	case job.Topic != "add" || string(job.Payload) != `{"job_id":1}` || job.Headers["X-Request-Id"] != "abc":
+		c.errorf("Relay sent job message %+v", job)
+	case job.CreatedAt.IsZero():
+		c.errorf("job message has no created_at")
+	}
+
+	sent, err = c.m.Outbox.Relay(100, func(msg *data.OutboxMessage) error {
+		c.errorf("Relay published message %d again", msg.ID)
+		return nil
+	})
+	c.expect("Relay with nothing pending", err, nil)
+	if sent != 0 {
+		c.errorf("Relay with nothing pending sent %d messages", sent)
+	}
+}
@@ -0,0 +1,166 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// ErrJobCompleted is returned when trying to complete a job which has already
+// succeeded.
+var ErrJobCompleted = errors.New("job already completed")
+
+// Define constants for the states a queued task creation job moves through.
+const (
+	JobPending    = "pending"
+	JobProcessing = "processing"
+	JobSucceeded  = "succeeded"
+	JobFailed     = "failed"
+)
+
+type Job struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	UserID    int64     `json:"-"`
+	Status    string    `json:"status"`
+	TaskID    int64     `json:"task_id,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Define a JobModel struct type which wraps a sql.DB connection pool.
+type JobModel struct {
+	DB *sql.DB
+}
+
+// Insert a new pending job for the given user, setting the system-generated ID on the
+// job struct. If message isn't nil, it's called with the job once its ID is known, and
+// the message it returns is written to the outbox in the same transaction, so that the
+// job is only saved if the message asking for it to be processed is too. Errors which
+// are worth retrying are wrapped in ErrTemporary.
+func (m JobModel) Insert(job *Job, message func(*Job) (*OutboxMessage, error)) error {
+	query := `
+		INSERT INTO jobs (created_at, updated_at, user_id, status)
+		VALUES (?, ?, ?, ?)`
+
+	job.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	job.UpdatedAt = job.CreatedAt
+	job.Status = JobPending
+
+	args := []interface{}{job.CreatedAt, job.UpdatedAt, job.UserID, job.Status}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := WithTx(ctx, m.DB, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+
+		job.ID, err = result.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		if message == nil {
+			return nil
+		}
+
+		msg, err := message(job)
+		if err != nil {
+			return err
+		}
+
+		return insertOutbox(ctx, tx, msg)
+	})
+	if isTemporary(err) {
+		return fmt.Errorf("%w: %s", ErrTemporary, err)
+	}
+
+	return err
+}
+
+// The isTemporary() helper reports whether err is a timeout, or a MySQL
+// ER_LOCK_WAIT_TIMEOUT or ER_LOCK_DEADLOCK error.
+func isTemporary(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == 1205 || mysqlErr.Number == 1213
+	}
+
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// Get fetches a specific job. The userID argument scopes the lookup so that users can
+// only see the jobs they submitted.
+func (m JobModel) Get(id int64, userID int64) (*Job, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, updated_at, user_id, status, COALESCE(task_id, 0), COALESCE(error, '')
+		FROM jobs
+		WHERE id = ? AND user_id = ?`
+
+	var job Job
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id, userID).Scan(
+		&job.ID,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+		&job.UserID,
+		&job.Status,
+		&job.TaskID,
+		&job.Error,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &job, nil
+}
+
+// UpdateStatus records the new state of a job, along with the resulting task ID or the
+// error text when there is one. A job which has succeeded stays that way, so moving it
+// to any other status returns ErrJobCompleted.
+func (m JobModel) UpdateStatus(id int64, status string, taskID int64, errText string) error {
+	query := `
+		UPDATE jobs
+		SET status = ?, task_id = NULLIF(?, 0), error = NULLIF(?, ''), updated_at = ?
+		WHERE id = ? AND (status <> ? OR ? = ?)`
+
+	args := []interface{}{status, taskID, errText, time.Now().UTC(), id, JobSucceeded, status, JobSucceeded}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return JobNotUpdated(ctx, m.DB, `SELECT COUNT(*) FROM jobs WHERE id = ?`, id)
+	}
+
+	return nil
+}
@@ -0,0 +1,706 @@
+// Package memory provides an in-memory storage backend for the data models. It is
+// registered with the data package under the name "memory", and is intended for demos
+// and tests where a MySQL server isn't available. All data is lost when the process
+// exits.
+package memory
+
+import (
+	"bytes"
+	"database/sql"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JacobNewton007/sendchamp-go-test/internal/data"
+)
+
+func init() {
+	data.Register("memory", func(*sql.DB) data.Models {
+		return New()
+	})
+}
+
+// store holds the data for every model behind a single mutex, so that queries which
+// span several tables (like UserModel.GetForToken) see a consistent view.
+type store struct {
+	mu sync.Mutex
+
+	tasks       map[int64]data.Tasks
+	jobs        map[int64]data.Job
+	users       map[int64]data.User
+	tokens      []data.Token
+	permissions map[int64][]string
+
+	// outbox holds the unsent outbox messages, oldest first. Sent messages are
+	// removed rather than marked, as nothing reads them again.
+	outbox []data.OutboxMessage
+
+	lastTaskID   int64
+	lastJobID    int64
+	lastUserID   int64
+	lastOutboxID int64
+
+	// relayMu stops two calls to OutboxModel.Relay() from publishing the same
+	// messages, as mu isn't held while publishing.
+	relayMu sync.Mutex
+}
+
+// permissionCodes lists the permissions seeded by the migrations. Like the MySQL
+// backend, AddForUser() silently ignores any other code.
+var permissionCodes = []string{"tasks:read", "tasks:write"}
+
+// New returns a Models struct backed by a new, empty in-memory store.
+func New() data.Models {
+	s := &store{
+		tasks:       make(map[int64]data.Tasks),
+		jobs:        make(map[int64]data.Job),
+		users:       make(map[int64]data.User),
+		permissions: make(map[int64][]string),
+	}
+
+	return data.Models{
+		Tasks:       TaskModel{s: s},
+		Jobs:        JobModel{s: s},
+		Outbox:      OutboxModel{s: s},
+		Permissions: PermissionModel{s: s},
+		Users:       UserModel{s: s},
+		Token:       TokenModel{s: s},
+	}
+}
+
+// The now() helper returns the current time at the one second precision of the
+// DATETIME columns used by the MySQL backend.
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+type TaskModel struct {
+	s *store
+}
+
+func (m TaskModel) Insert(task *data.Tasks) (int64, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	stored := *task
+	stored.ID = m.s.lastTaskID + 1
+	stored.CreatedAt = now()
+	stored.Version = 1
+
+	msg, err := data.NewTaskEvent(data.TopicTaskCreated, &stored)
+	if err != nil {
+		return 0, err
+	}
+
+	m.s.lastTaskID = stored.ID
+	m.s.tasks[stored.ID] = stored
+	m.s.appendOutbox(msg)
+
+	return stored.ID, nil
+}
+
+func (m TaskModel) InsertForJob(task *data.Tasks, jobID int64) (int64, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	job, ok := m.s.jobs[jobID]
+	if !ok {
+		return 0, data.ErrRecordNotFound
+	}
+	if job.Status == data.JobSucceeded {
+		return 0, data.ErrJobCompleted
+	}
+
+	stored := *task
+	stored.ID = m.s.lastTaskID + 1
+	stored.CreatedAt = now()
+	stored.Version = 1
+
+	msg, err := data.NewTaskEvent(data.TopicTaskCreated, &stored)
+	if err != nil {
+		return 0, err
+	}
+
+	m.s.lastTaskID = stored.ID
+	m.s.tasks[stored.ID] = stored
+	m.s.appendOutbox(msg)
+
+	job.Status = data.JobSucceeded
+	job.TaskID = stored.ID
+	job.Error = ""
+	job.UpdatedAt = now()
+	m.s.jobs[jobID] = job
+
+	return stored.ID, nil
+}
+
+func (m TaskModel) Get(id int64, ownerID int64) (*data.Tasks, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	task, ok := m.s.tasks[id]
+	if !ok || task.OwnerID != ownerID {
+		return nil, data.ErrRecordNotFound
+	}
+
+	return &task, nil
+}
+
+func (m TaskModel) GetAll(ownerID int64, title string, createdBy string, filters data.Filters) ([]*data.Tasks, data.Metadata, error) {
+	// Resolve the sort column first, so that an unsafe value panics in the same way
+	// as it does for the MySQL backend.
+	column, direction := filters.SortColumn(), filters.SortDirection()
+
+	m.s.mu.Lock()
+
+	var matches []data.Tasks
+
+	for _, task := range m.s.tasks {
+		if task.OwnerID != ownerID {
+			continue
+		}
+		if title != "" && !matchesFullText(task.Title, title) {
+			continue
+		}
+		if createdBy != "" && task.CreatedBy != createdBy {
+			continue
+		}
+		matches = append(matches, task)
+	}
+
+	m.s.mu.Unlock()
+
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+
+		var cmp int
+		switch column {
+		case "title":
+			cmp = strings.Compare(strings.ToLower(a.Title), strings.ToLower(b.Title))
+		case "created_at":
+			cmp = compareInt64(a.CreatedAt.UnixNano(), b.CreatedAt.UnixNano())
+		default:
+			cmp = compareInt64(a.ID, b.ID)
+		}
+
+		if direction == "DESC" {
+			cmp = -cmp
+		}
+
+		// Break ties on the ID, matching the "ORDER BY ..., id ASC" in the SQL query.
+		if cmp == 0 {
+			return a.ID < b.ID
+		}
+		return cmp < 0
+	})
+
+	metadata := data.CalculateMetadata(len(matches), filters.Page, filters.PageSize)
+
+	tasks := []*data.Tasks{}
+
+	for i := filters.Offset(); i < len(matches) && len(tasks) < filters.Limit(); i++ {
+		task := matches[i]
+		tasks = append(tasks, &task)
+	}
+
+	return tasks, metadata, nil
+}
+
+func (m TaskModel) Update(task *data.Tasks) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	stored, ok := m.s.tasks[task.ID]
+	if !ok || stored.OwnerID != task.OwnerID || stored.Version != task.Version {
+		return data.ErrEditConflict
+	}
+
+	stored.Title = task.Title
+	stored.CreatedBy = task.CreatedBy
+	stored.Version++
+
+	msg, err := data.NewTaskEvent(data.TopicTaskUpdated, &stored)
+	if err != nil {
+		return err
+	}
+
+	m.s.tasks[stored.ID] = stored
+	m.s.appendOutbox(msg)
+	task.Version = stored.Version
+
+	return nil
+}
+
+func (m TaskModel) Delete(id int64, ownerID int64) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	task, ok := m.s.tasks[id]
+	if !ok || task.OwnerID != ownerID {
+		return data.ErrRecordNotFound
+	}
+
+	msg, err := data.NewTaskEvent(data.TopicTaskDeleted, &data.Tasks{ID: id, OwnerID: ownerID})
+	if err != nil {
+		return err
+	}
+
+	delete(m.s.tasks, id)
+	m.s.appendOutbox(msg)
+
+	return nil
+}
+
+// The matchesFullText() helper approximates MySQL's natural language full-text search:
+// a title matches if it contains any of the words in the query, ignoring case.
+func matchesFullText(title, query string) bool {
+	words := make(map[string]bool)
+	for _, word := range strings.Fields(strings.ToLower(title)) {
+		words[word] = true
+	}
+
+	for _, word := range strings.Fields(strings.ToLower(query)) {
+		if words[word] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+type JobModel struct {
+	s *store
+}
+
+func (m JobModel) Insert(job *data.Job, message func(*data.Job) (*data.OutboxMessage, error)) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	job.ID = m.s.lastJobID + 1
+	job.CreatedAt = now()
+	job.UpdatedAt = job.CreatedAt
+	job.Status = data.JobPending
+
+	// Build the message before storing anything, so that the job isn't stored
+	// without it if message fails.
+	var msg *data.OutboxMessage
+	if message != nil {
+		var err error
+		msg, err = message(job)
+		if err != nil {
+			return err
+		}
+	}
+
+	m.s.lastJobID = job.ID
+	m.s.jobs[job.ID] = *job
+
+	if msg != nil {
+		m.s.appendOutbox(msg)
+	}
+
+	return nil
+}
+
+func (m JobModel) Get(id int64, userID int64) (*data.Job, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	job, ok := m.s.jobs[id]
+	if !ok || job.UserID != userID {
+		return nil, data.ErrRecordNotFound
+	}
+
+	return &job, nil
+}
+
+func (m JobModel) UpdateStatus(id int64, status string, taskID int64, errText string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	job, ok := m.s.jobs[id]
+	if !ok {
+		return data.ErrRecordNotFound
+	}
+	if job.Status == data.JobSucceeded && status != data.JobSucceeded {
+		return data.ErrJobCompleted
+	}
+
+	job.Status = status
+	job.TaskID = taskID
+	job.Error = errText
+	job.UpdatedAt = now()
+
+	m.s.jobs[id] = job
+
+	return nil
+}
+
+// The appendOutbox() method adds msg to the outbox. The caller must hold s.mu.
+func (s *store) appendOutbox(msg *data.OutboxMessage) {
+	s.lastOutboxID++
+
+	msg.ID = s.lastOutboxID
+	msg.CreatedAt = now()
+
+	s.outbox = append(s.outbox, *msg)
+}
+
+type OutboxModel struct {
+	s *store
+}
+
+// Relay passes up to limit unsent messages to publish, oldest first, and removes the
+// ones it publishes from the outbox. The store isn't locked while publishing, so that
+// a slow broker doesn't hold up the other models.
+func (m OutboxModel) Relay(limit int, publish func(*data.OutboxMessage) error) (int, error) {
+	m.s.relayMu.Lock()
+	defer m.s.relayMu.Unlock()
+
+	m.s.mu.Lock()
+	n := len(m.s.outbox)
+	if n > limit {
+		n = limit
+	}
+
+	messages := make([]*data.OutboxMessage, n)
+	for i := range messages {
+		msg := m.s.outbox[i]
+		messages[i] = &msg
+	}
+	m.s.mu.Unlock()
+
+	sent := data.RelayBatch(messages, publish)
+	if len(sent) == 0 {
+		return 0, nil
+	}
+
+	isSent := make(map[int64]bool, len(sent))
+	for _, id := range sent {
+		isSent[id] = true
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	// Messages may have been added while we were publishing, so filter the current
+	// outbox rather than the copy.
+	pending := m.s.outbox[:0]
+	for _, msg := range m.s.outbox {
+		if !isSent[msg.ID] {
+			pending = append(pending, msg)
+		}
+	}
+	m.s.outbox = pending
+
+	return len(sent), nil
+}
+
+type PermissionModel struct {
+	s *store
+}
+
+func (m PermissionModel) GetAllForUser(userID int64) (data.Permissions, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	if len(m.s.permissions[userID]) == 0 {
+		return nil, nil
+	}
+
+	return append(data.Permissions(nil), m.s.permissions[userID]...), nil
+}
+
+func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	m.s.addPermissions(userID, codes)
+
+	return nil
+}
+
+// The addPermissions() method grants the user the codes they don't already have. The
+// caller must hold s.mu.
+func (s *store) addPermissions(userID int64, codes []string) {
+	existing := data.Permissions(s.permissions[userID])
+
+	for _, code := range codes {
+		known := false
+		for _, c := range permissionCodes {
+			if c == code {
+				known = true
+			}
+		}
+
+		if known && !existing.Include(code) {
+			existing = append(existing, code)
+		}
+	}
+
+	s.permissions[userID] = existing
+}
+
+type UserModel struct {
+	s *store
+}
+
+func (m UserModel) Insert(user *data.User) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	return m.insert(user)
+}
+
+// Register inserts the user, grants their permissions and stores their token while
+// holding the mutex, so that other callers see all of it or none of it.
+func (m UserModel) Register(user *data.User, token *data.Token, permissions ...string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	err := m.insert(user)
+	if err != nil {
+		return err
+	}
+
+	m.s.addPermissions(user.ID, permissions)
+
+	token.UserID = user.ID
+	m.s.insertToken(token)
+
+	return nil
+}
+
+// The insert() method does the work for Insert() and Register(). The caller must hold
+// the store's mutex.
+func (m UserModel) insert(user *data.User) error {
+	if m.emailTaken(user.Email, 0) {
+		return data.ErrDuplicateEmail
+	}
+
+	m.s.lastUserID++
+
+	stored := *user
+	stored.ID = m.s.lastUserID
+	stored.Email = strings.ToLower(user.Email)
+	stored.CreatedAt = now()
+	stored.Version = 1
+
+	m.s.users[stored.ID] = stored
+	user.ID = stored.ID
+
+	return nil
+}
+
+func (m UserModel) Get(id int64) (*data.User, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	user, ok := m.s.users[id]
+	if !ok {
+		return nil, data.ErrRecordNotFound
+	}
+
+	return &user, nil
+}
+
+func (m UserModel) GetByEmail(email string) (*data.User, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	for _, user := range m.s.users {
+		if user.Email == strings.ToLower(email) {
+			return &user, nil
+		}
+	}
+
+	return nil, data.ErrRecordNotFound
+}
+
+func (m UserModel) Update(user *data.User) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	stored, ok := m.s.users[user.ID]
+	if !ok || stored.Version != user.Version {
+		return data.ErrEditConflict
+	}
+
+	if m.emailTaken(user.Email, user.ID) {
+		return data.ErrDuplicateEmail
+	}
+
+	createdAt := stored.CreatedAt
+
+	stored = *user
+	stored.Email = strings.ToLower(user.Email)
+	stored.CreatedAt = createdAt
+	stored.Version++
+
+	m.s.users[stored.ID] = stored
+	user.Version = stored.Version
+
+	return nil
+}
+
+func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*data.User, error) {
+	tokenHash := data.HashToken(tokenPlaintext)
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	for _, token := range m.s.tokens {
+		if token.Scope == tokenScope && bytes.Equal(token.Hash, tokenHash) && token.Expiry.After(time.Now()) {
+			user, ok := m.s.users[token.UserID]
+			if !ok {
+				break
+			}
+			return &user, nil
+		}
+	}
+
+	return nil, data.ErrRecordNotFound
+}
+
+// The emailTaken() method reports whether a user other than exceptID already has the
+// email address. Like the UNIQUE constraint in MySQL, the check ignores case. The
+// caller must hold the store's mutex.
+func (m UserModel) emailTaken(email string, exceptID int64) bool {
+	for id, user := range m.s.users {
+		if id != exceptID && user.Email == strings.ToLower(email) {
+			return true
+		}
+	}
+	return false
+}
+
+type TokenModel struct {
+	s *store
+}
+
+func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*data.Token, error) {
+	return m.NewForFamily(userID, ttl, scope, nil)
+}
+
+func (m TokenModel) NewForFamily(userID int64, ttl time.Duration, scope string, family []byte) (*data.Token, error) {
+	token, err := data.GenerateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	token.Family = family
+
+	err = m.Insert(token)
+	return token, err
+}
+
+func (m TokenModel) Insert(token *data.Token) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	m.s.insertToken(token)
+
+	return nil
+}
+
+// The insertToken() method stores a copy of the token. The caller must hold s.mu.
+func (s *store) insertToken(token *data.Token) {
+	// Only the hash is stored, never the plaintext.
+	stored := *token
+	stored.Plaintext = ""
+
+	s.tokens = append(s.tokens, stored)
+}
+
+func (m TokenModel) GetByHash(scope string, hash []byte) (*data.Token, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	for _, token := range m.s.tokens {
+		if token.Scope == scope && bytes.Equal(token.Hash, hash) && token.Expiry.After(time.Now()) {
+			return &token, nil
+		}
+	}
+
+	return nil, data.ErrRecordNotFound
+}
+
+func (m TokenModel) MarkUsed(scope string, hash []byte) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	for i := range m.s.tokens {
+		token := &m.s.tokens[i]
+		if token.Scope == scope && bytes.Equal(token.Hash, hash) && !token.Used {
+			token.Used = true
+			return nil
+		}
+	}
+
+	return data.ErrEditConflict
+}
+
+func (m TokenModel) DeleteByHash(scope string, hash []byte) error {
+	n := m.deleteWhere(func(token data.Token) bool {
+		return token.Scope == scope && bytes.Equal(token.Hash, hash)
+	})
+
+	if n == 0 {
+		return data.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
+	m.deleteWhere(func(token data.Token) bool {
+		return token.Scope == scope && token.UserID == userID
+	})
+
+	return nil
+}
+
+func (m TokenModel) DeleteAllForFamily(scope string, family []byte) error {
+	// In SQL "family = NULL" never matches, so tokens without a family are never
+	// deleted here.
+	if family == nil {
+		return nil
+	}
+
+	m.deleteWhere(func(token data.Token) bool {
+		return token.Scope == scope && bytes.Equal(token.Family, family)
+	})
+
+	return nil
+}
+
+// The deleteWhere() method removes every token matching the predicate and returns how
+// many were removed.
+func (m TokenModel) deleteWhere(match func(data.Token) bool) int {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	kept := m.s.tokens[:0]
+	for _, token := range m.s.tokens {
+		if !match(token) {
+			kept = append(kept, token)
+		}
+	}
+
+	n := len(m.s.tokens) - len(kept)
+	m.s.tokens = kept
+
+	return n
+}
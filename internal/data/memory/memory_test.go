@@ -0,0 +1,14 @@
+package memory_test
+
+import (
+	"testing"
+
+	"github.com/JacobNewton007/sendchamp-go-test/internal/data/datatest"
+	"github.com/JacobNewton007/sendchamp-go-test/internal/data/memory"
+)
+
+func TestModels(t *testing.T) {
+	if err := datatest.TestModels(memory.New()); err != nil {
+		t.Fatal(err)
+	}
+}
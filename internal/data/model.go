@@ -3,6 +3,10 @@ package data
 import (
 	"database/sql"
 	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
 )
 
 // Define a custom ErrRecordNotFound error. We'll return this from our Get() method
@@ -12,19 +16,126 @@ var (
 	ErrEditConflict   = errors.New("edit conflict")
 )
 
+// ErrTemporary is wrapped around errors which are likely to go away if the operation
+// is retried, like a query timing out or being chosen as a deadlock victim.
+var ErrTemporary = errors.New("temporary database error")
+
+// The store interfaces below describe everything the application needs from each
+// model. TaskModel, UserModel and friends implement them on top of MySQL, and other
+// backends (like the one in internal/data/memory) must behave in the same way,
+// including which of the errors above they return.
+
+type TaskStore interface {
+	Insert(task *Tasks) (int64, error)
+	InsertForJob(task *Tasks, jobID int64) (int64, error)
+	Get(id int64, ownerID int64) (*Tasks, error)
+	GetAll(ownerID int64, title string, createdBy string, filters Filters) ([]*Tasks, Metadata, error)
+	Update(task *Tasks) error
+	Delete(id int64, ownerID int64) error
+}
+
+type JobStore interface {
+	Insert(job *Job, message func(*Job) (*OutboxMessage, error)) error
+	Get(id int64, userID int64) (*Job, error)
+	UpdateStatus(id int64, status string, taskID int64, errText string) error
+}
+
+type OutboxStore interface {
+	Relay(limit int, publish func(*OutboxMessage) error) (int, error)
+}
+
+type PermissionStore interface {
+	GetAllForUser(userID int64) (Permissions, error)
+	AddForUser(userID int64, codes ...string) error
+}
+
+type UserStore interface {
+	Insert(user *User) error
+	Register(user *User, token *Token, permissions ...string) error
+	Get(id int64) (*User, error)
+	GetByEmail(email string) (*User, error)
+	Update(user *User) error
+	GetForToken(tokenScope, tokenPlaintext string) (*User, error)
+}
+
+type TokenStore interface {
+	New(userID int64, ttl time.Duration, scope string) (*Token, error)
+	NewForFamily(userID int64, ttl time.Duration, scope string, family []byte) (*Token, error)
+	Insert(token *Token) error
+	GetByHash(scope string, hash []byte) (*Token, error)
+	MarkUsed(scope string, hash []byte) error
+	DeleteByHash(scope string, hash []byte) error
+	DeleteAllForUser(scope string, userID int64) error
+	DeleteAllForFamily(scope string, family []byte) error
+}
+
 // Create a models struct which wraps the MovieModel.
 type Models struct {
-	Tasks TaskModel
-	Users UserModel
-	Token TokenModel
+	Tasks       TaskStore
+	Jobs        JobStore
+	Outbox      OutboxStore
+	Permissions PermissionStore
+	Users       UserStore
+	Token       TokenStore
+}
+
+// Backend is a function which builds a Models struct for a storage backend. The db
+// argument is nil for backends which don't use a SQL database.
+type Backend func(db *sql.DB) Models
+
+var (
+	backendsMu sync.RWMutex
+	backends   = map[string]Backend{"mysql": newMySQLModels}
+)
+
+// Register makes a storage backend available to NewModels() under the given name, in
+// the same way that database/sql drivers register themselves. It's intended to be
+// called from the init() function of the backend's package.
+func Register(name string, backend Backend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	if _, exists := backends[name]; exists {
+		panic("data: Register called twice for backend " + name)
+	}
+	backends[name] = backend
+}
+
+// Backends returns the sorted names of the registered storage backends.
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
 }
 
 // For ease of use, we also add a New() method which returns a Models struct containing
-// the initialized MovieModel.
-func NewModels(db *sql.DB) Models {
+// the initialized models for the named backend.
+func NewModels(driver string, db *sql.DB) (Models, error) {
+	backendsMu.RLock()
+	backend, ok := backends[driver]
+	backendsMu.RUnlock()
+
+	if !ok {
+		return Models{}, fmt.Errorf("unknown storage backend %q (forgotten import?)", driver)
+	}
+
+	return backend(db), nil
+}
+
+func newMySQLModels(db *sql.DB) Models {
 	return Models{
-		Tasks: TaskModel{DB: db},
-		Token: TokenModel{DB: db},
-		Users: UserModel{DB: db},
+		Tasks:       TaskModel{DB: db},
+		Jobs:        JobModel{DB: db},
+		Outbox:      OutboxModel{DB: db},
+		Permissions: PermissionModel{DB: db},
+		Token:       TokenModel{DB: db},
+		Users:       UserModel{DB: db},
 	}
 }
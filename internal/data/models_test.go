@@ -0,0 +1,55 @@
+package data_test
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/JacobNewton007/sendchamp-go-test/internal/data"
+	"github.com/JacobNewton007/sendchamp-go-test/internal/data/datatest"
+	"github.com/JacobNewton007/sendchamp-go-test/internal/migrate"
+	"github.com/JacobNewton007/sendchamp-go-test/migrations"
+)
+
+// TestModels runs the conformance suite against the MySQL models. It needs an empty
+// MySQL 8 database, given by a DSN such as
+// "user:pass@tcp(localhost:3306)/sendchamp_test?parseTime=true" in the
+// SENDCHAMP_TEST_MYSQL_DSN environment variable, and is skipped otherwise. The
+// migrations are applied before the checks and rolled back afterwards.
+func TestModels(t *testing.T) {
+	dsn := os.Getenv("SENDCHAMP_TEST_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("SENDCHAMP_TEST_MYSQL_DSN not set")
+	}
+
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	m, err := migrate.New(db, "mysql", migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	applied, err := m.Up(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if _, err := m.Down(context.Background(), len(applied)); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	models, err := data.NewModels("mysql", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := datatest.TestModels(models); err != nil {
+		t.Error(err)
+	}
+}
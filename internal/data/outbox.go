@@ -0,0 +1,490 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Define the aggregate types and topics of the messages written to the outbox. Every
+// change to a task is recorded as a task.* event.
+const (
+	AggregateJob  = "job"
+	AggregateTask = "task"
+
+	TopicTaskCreated = "task.created"
+	TopicTaskUpdated = "task.updated"
+	TopicTaskDeleted = "task.deleted"
+)
+
+// outboxLease is how long a relay has to publish the batch of messages it has claimed.
+// If it hasn't recorded them as sent by then, because it crashed or the broker is
+// slow, the messages can be claimed again.
+const outboxLease = 30 * time.Second
+
+// OutboxMessage is a message waiting in the outbox to be published to RabbitMQ. It is
+// written in the same transaction as the change it describes, so the message exists
+// if and only if the change was committed. A relay publishes it afterwards.
+//
+// Messages for the same aggregate (a job, or a task) are published in the order they
+// were written.
+type OutboxMessage struct {
+	ID            int64
+	CreatedAt     time.Time
+	AggregateType string
+	AggregateID   int64
+	Topic         string
+	Payload       []byte
+	Headers       OutboxHeaders
+}
+
+// OutboxHeaders holds the headers for an outbox message, like the request ID and trace
+// context. They're stored as a JSON object, or NULL if there are none.
+type OutboxHeaders map[string]string
+
+// Value implements the driver.Valuer interface.
+func (h OutboxHeaders) Value() (driver.Value, error) {
+	if len(h) == 0 {
+		return nil, nil
+	}
+
+	js, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(js), nil
+}
+
+// Scan implements the sql.Scanner interface.
+func (h *OutboxHeaders) Scan(src interface{}) error {
+	var js []byte
+
+	switch src := src.(type) {
+	case nil:
+		*h = nil
+		return nil
+	case []byte:
+		js = src
+	case string:
+		js = []byte(src)
+	default:
+		return fmt.Errorf("can't scan %T into OutboxHeaders", src)
+	}
+
+	return json.Unmarshal(js, h)
+}
+
+// TaskEvent is the payload of the task.* messages. Deleted events only carry the IDs.
+type TaskEvent struct {
+	TaskID    int64  `json:"task_id"`
+	OwnerID   int64  `json:"owner_id"`
+	Title     string `json:"title,omitempty"`
+	CreatedBy string `json:"created_by,omitempty"`
+	Version   int32  `json:"version,omitempty"`
+}
+
+// NewTaskEvent returns the outbox message for a change to task.
+func NewTaskEvent(topic string, task *Tasks) (*OutboxMessage, error) {
+	event := TaskEvent{
+		TaskID:  task.ID,
+		OwnerID: task.OwnerID,
+	}
+
+	if topic != TopicTaskDeleted {
+		event.Title = task.Title
+		event.CreatedBy = task.CreatedBy
+		event.Version = task.Version
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OutboxMessage{
+		AggregateType: AggregateTask,
+		AggregateID:   task.ID,
+		Topic:         topic,
+		Payload:       payload,
+	}, nil
+}
+
+// RelayBatch passes messages, which must be in the order they were written, to
+// publish and returns the IDs of the ones which were published. Once publishing a
+// message fails, the rest of the messages for the same aggregate are skipped, so that
+// they're never published ahead of it. It's shared by the OutboxStore implementations.
+func RelayBatch(messages []*OutboxMessage, publish func(*OutboxMessage) error) []int64 {
+	type aggregate struct {
+		typ string
+		id  int64
+	}
+
+	failed := make(map[aggregate]bool)
+	var sent []int64
+
+	for _, msg := range messages {
+		key := aggregate{msg.AggregateType, msg.AggregateID}
+		if failed[key] {
+			continue
+		}
+
+		err := publish(msg)
+		if err != nil {
+			failed[key] = true
+			continue
+		}
+
+		sent = append(sent, msg.ID)
+	}
+
+	return sent
+}
+
+// The insertOutbox() helper writes msg to the outbox as part of tx.
+func insertOutbox(ctx context.Context, tx *sql.Tx, msg *OutboxMessage) error {
+	query := `
+		INSERT INTO outbox (created_at, aggregate_type, aggregate_id, topic, payload, headers)
+		VALUES (?, ?, ?, ?, ?, ?)`
+
+	msg.CreatedAt = time.Now().UTC().Truncate(time.Second)
+
+	args := []interface{}{msg.CreatedAt, msg.AggregateType, msg.AggregateID, msg.Topic, msg.Payload, msg.Headers}
+
+	result, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	msg.ID, err = result.LastInsertId()
+	return err
+}
+
+// Define an OutboxModel struct type which wraps a sql.DB connection pool.
+type OutboxModel struct {
+	DB *sql.DB
+}
+
+// Relay passes up to limit unsent messages to publish, oldest first, and marks the
+// ones it publishes as sent. It returns the number of messages sent. Messages which
+// publish fails for, and the later ones for the same aggregate, are left for the next
+// call, so delivery is at-least-once: a message can be published again if we fail to
+// record that it was sent.
+//
+// It needs MySQL 8.0 or later, for SKIP LOCKED. The claim runs at READ COMMITTED, so
+// that InnoDB only locks the rows it returns and not the gaps between them, which
+// would block new messages being written to the outbox.
+func (m OutboxModel) Relay(limit int, publish func(*OutboxMessage) error) (int, error) {
+	return RelayOutbox(m.DB, OutboxDialect{
+		Placeholder: func(int) string { return "?" },
+		LockRows:    "FOR UPDATE SKIP LOCKED",
+		Isolation:   sql.LevelReadCommitted,
+	}, limit, publish)
+}
+
+// OutboxDialect describes how RelayOutbox() talks to a particular database.
+type OutboxDialect struct {
+	// Placeholder returns the placeholder for the nth parameter of a query, counting
+	// from 1.
+	Placeholder func(n int) string
+	// LockRows is appended to the query which claims messages, so that relays running
+	// at the same time claim different ones. It's empty if the database has no row
+	// locks.
+	LockRows string
+	// Isolation is the isolation level of the transaction which claims messages.
+	Isolation sql.IsolationLevel
+}
+
+// The placeholders() method returns a comma-separated list of n placeholders, the
+// first of which is for parameter number first.
+func (d OutboxDialect) placeholders(first, n int) string {
+	list := make([]string, n)
+	for i := range list {
+		list[i] = d.Placeholder(first + i)
+	}
+	return strings.Join(list, ", ")
+}
+
+// RelayOutbox implements OutboxModel.Relay() for the SQL backends. No transaction is
+// held open while publishing, as a slow broker would then hold locks on the outbox
+// and hold up the requests writing to it. Instead, it works in three steps:
+//
+//  1. In a short transaction, it claims a batch of messages by setting claimed_until
+//     to the end of a lease, skipping the ones other relays have claimed.
+//  2. It publishes the messages, stopping early if the lease is running out.
+//  3. In another short transaction, it marks the published messages as sent and
+//     releases its claim on the rest.
+//
+// A message is only claimed along with every earlier unsent message for the same
+// aggregate, so two relays never publish the messages for an aggregate side by side,
+// possibly out of order. If the first pending message for an aggregate belongs to
+// another relay, the aggregate is left alone until that relay has finished with it.
+func RelayOutbox(db *sql.DB, dialect OutboxDialect, limit int, publish func(*OutboxMessage) error) (int, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+	claimedUntil := now.Add(outboxLease)
+
+	messages, err := claimOutbox(db, dialect, limit, now, claimedUntil)
+	if err != nil || len(messages) == 0 {
+		return 0, err
+	}
+
+	// Stop publishing halfway through the lease, which leaves plenty of time to record
+	// what was sent before another relay could claim the messages.
+	deadline := now.Add(outboxLease / 2)
+
+	sent := RelayBatch(messages, func(msg *OutboxMessage) error {
+		if time.Now().After(deadline) {
+			return errors.New("outbox lease expiring")
+		}
+		return publish(msg)
+	})
+
+	var unsent []int64
+
+	isSent := make(map[int64]bool, len(sent))
+	for _, id := range sent {
+		isSent[id] = true
+	}
+	for _, msg := range messages {
+		if !isSent[msg.ID] {
+			unsent = append(unsent, msg.ID)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = WithTx(ctx, db, func(tx *sql.Tx) error {
+		if len(sent) > 0 {
+			query := fmt.Sprintf(`
+				UPDATE outbox SET sent_at = %s, claimed_until = NULL
+				WHERE id IN (%s)`,
+				dialect.Placeholder(1), dialect.placeholders(2, len(sent)))
+
+			args := []interface{}{time.Now().UTC()}
+			for _, id := range sent {
+				args = append(args, id)
+			}
+
+			_, err := tx.ExecContext(ctx, query, args...)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(unsent) > 0 {
+			// Only release the messages if they're still ours, in case the lease ran
+			// out and another relay has claimed them since.
+			query := fmt.Sprintf(`
+				UPDATE outbox SET claimed_until = NULL
+				WHERE claimed_until = %s AND id IN (%s)`,
+				dialect.Placeholder(1), dialect.placeholders(2, len(unsent)))
+
+			args := []interface{}{claimedUntil}
+			for _, id := range unsent {
+				args = append(args, id)
+			}
+
+			_, err := tx.ExecContext(ctx, query, args...)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(sent), nil
+}
+
+// The claimOutbox() helper claims up to limit unsent messages until claimedUntil, and
+// returns them in the order they were written.
+func claimOutbox(db *sql.DB, dialect OutboxDialect, limit int, now, claimedUntil time.Time) ([]*OutboxMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: dialect.Isolation})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf(`
+		SELECT id, created_at, aggregate_type, aggregate_id, topic, payload, headers
+		FROM outbox
+		WHERE sent_at IS NULL AND (claimed_until IS NULL OR claimed_until < %s)
+		ORDER BY id
+		LIMIT %s
+		%s`,
+		dialect.Placeholder(1), dialect.Placeholder(2), dialect.LockRows)
+
+	rows, err := tx.QueryContext(ctx, query, now, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	messages, err := scanOutbox(rows)
+	if err != nil || len(messages) == 0 {
+		return nil, err
+	}
+
+	type aggregate struct {
+		typ string
+		id  int64
+	}
+
+	batch := make(map[int64]*OutboxMessage, len(messages))
+	var aggregates []aggregate
+	seen := make(map[aggregate]bool)
+
+	for _, msg := range messages {
+		batch[msg.ID] = msg
+
+		key := aggregate{msg.AggregateType, msg.AggregateID}
+		if !seen[key] {
+			seen[key] = true
+			aggregates = append(aggregates, key)
+		}
+	}
+
+	// Look up every unsent message for the aggregates in the batch, including ones
+	// which are locked or claimed by other relays. For each aggregate we keep the
+	// messages in the batch up to the first one which isn't.
+	var conds []string
+	var args []interface{}
+
+	for _, key := range aggregates {
+		conds = append(conds, fmt.Sprintf("(aggregate_type = %s AND aggregate_id = %s)",
+			dialect.Placeholder(len(args)+1), dialect.Placeholder(len(args)+2)))
+		args = append(args, key.typ, key.id)
+	}
+
+	query = `
+		SELECT id, aggregate_type, aggregate_id
+		FROM outbox
+		WHERE sent_at IS NULL AND (` + strings.Join(conds, " OR ") + `)
+		ORDER BY id`
+
+	rows, err = tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var claimed []*OutboxMessage
+	blocked := make(map[aggregate]bool)
+
+	for rows.Next() {
+		var id int64
+		var key aggregate
+
+		err := rows.Scan(&id, &key.typ, &key.id)
+		if err != nil {
+			return nil, err
+		}
+
+		if blocked[key] {
+			continue
+		}
+
+		msg, ok := batch[id]
+		if !ok {
+			blocked[key] = true
+			continue
+		}
+
+		claimed = append(claimed, msg)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Close the rows now, as SQLite only has a single connection, which is needed for
+	// the update below.
+	rows.Close()
+
+	if len(claimed) == 0 {
+		return nil, nil
+	}
+
+	// The lookup returned the messages in ID order, so claimed still is.
+	query = fmt.Sprintf(`UPDATE outbox SET claimed_until = %s WHERE id IN (%s)`,
+		dialect.Placeholder(1), dialect.placeholders(2, len(claimed)))
+
+	args = []interface{}{claimedUntil}
+	for _, msg := range claimed {
+		args = append(args, msg.ID)
+	}
+
+	_, err = tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return claimed, nil
+}
+
+// The scanOutbox() helper reads the outbox messages from rows and closes them.
+func scanOutbox(rows *sql.Rows) ([]*OutboxMessage, error) {
+	defer rows.Close()
+
+	messages := []*OutboxMessage{}
+
+	for rows.Next() {
+		var msg OutboxMessage
+
+		err := rows.Scan(
+			&msg.ID,
+			&msg.CreatedAt,
+			&msg.AggregateType,
+			&msg.AggregateID,
+			&msg.Topic,
+			&msg.Payload,
+			&msg.Headers,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, &msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// WithTx runs fn in a transaction, committing it if fn returns nil and rolling it back
+// otherwise. It's shared by the SQL backends.
+func WithTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil && !errors.Is(rbErr, sql.ErrTxDone) {
+			return fmt.Errorf("%w (rollback failed: %v)", err, rbErr)
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
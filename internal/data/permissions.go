@@ -0,0 +1,97 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// Define a Permissions slice, which we will use to hold the permission codes (like
+// "tasks:read" and "tasks:write") for a single user.
+type Permissions []string
+
+// Add a helper method to check whether the Permissions slice contains a specific
+// permission code.
+func (p Permissions) Include(code string) bool {
+	for i := range p {
+		if code == p[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// Define the PermissionModel type.
+type PermissionModel struct {
+	DB *sql.DB
+}
+
+// The GetAllForUser() method returns all permission codes for a specific user in a
+// Permissions slice.
+func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+	query := `
+		SELECT permissions.code
+		FROM permissions
+		INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+		INNER JOIN users ON users_permissions.user_id = users.id
+		WHERE users.id = ?`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var permissions Permissions
+
+	for rows.Next() {
+		var permission string
+
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+// Add the provided permission codes for a specific user. Codes the user already has
+// are ignored, so it's safe to call this more than once with the same codes.
+func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return addPermissions(ctx, m.DB, userID, codes)
+}
+
+func addPermissions(ctx context.Context, db execer, userID int64, codes []string) error {
+	if len(codes) == 0 {
+		return nil
+	}
+
+	// Build one placeholder per code for the IN clause, and prepend the user ID to
+	// the args so that it fills the first placeholder in the SELECT list.
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(codes)), ", ")
+
+	query := `
+		INSERT IGNORE INTO users_permissions (user_id, permission_id)
+		SELECT ?, permissions.id FROM permissions WHERE permissions.code IN (` + placeholders + `)`
+
+	args := []interface{}{userID}
+	for _, code := range codes {
+		args = append(args, code)
+	}
+
+	_, err := db.ExecContext(ctx, query, args...)
+	return err
+}
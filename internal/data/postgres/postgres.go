@@ -0,0 +1,803 @@
+// Package postgres provides a PostgreSQL storage backend for the data models. It is
+// registered with the data package under the name "postgres", and expects the schema
+// from migrations/postgres.
+//
+// Unlike MySQL, PostgreSQL supports RETURNING on every statement, so system-generated
+// values are read back in the same round-trip. Constraint violations are detected from
+// their SQLSTATE code rather than from the error text.
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/JacobNewton007/sendchamp-go-test/internal/data"
+	"github.com/lib/pq"
+)
+
+func init() {
+	data.Register("postgres", New)
+}
+
+// New returns a Models struct which uses the PostgreSQL connection pool.
+func New(db *sql.DB) data.Models {
+	return data.Models{
+		Tasks:       TaskModel{DB: db},
+		Jobs:        JobModel{DB: db},
+		Outbox:      OutboxModel{DB: db},
+		Permissions: PermissionModel{DB: db},
+		Users:       UserModel{DB: db},
+		Token:       TokenModel{DB: db},
+	}
+}
+
+// SQLSTATE 23505 is unique_violation.
+const uniqueViolation = "23505"
+
+// The isUniqueViolation() helper reports whether err was caused by a UNIQUE
+// constraint.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == uniqueViolation
+}
+
+// The isTemporary() helper reports whether err is a timeout, or one of the errors
+// worth retrying: SQLSTATE 40001 (serialization_failure), 40P01 (deadlock_detected),
+// 55P03 (lock_not_available) or 57014 (query_canceled, which includes statement
+// timeouts).
+func isTemporary(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "40001", "40P01", "55P03", "57014":
+			return true
+		}
+		return false
+	}
+
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+type TaskModel struct {
+	DB *sql.DB
+}
+
+func (m TaskModel) Insert(task *data.Tasks) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int64
+
+	err := data.WithTx(ctx, m.DB, func(tx *sql.Tx) error {
+		var err error
+		id, err = insertTask(ctx, tx, task)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// InsertForJob works like the MySQL version. Under READ COMMITTED, an update which
+// waits for a concurrent transaction completing the same job re-checks the WHERE
+// clause against its result, so only one of them succeeds.
+func (m TaskModel) InsertForJob(task *data.Tasks, jobID int64) (int64, error) {
+	query := `
+		UPDATE jobs
+		SET status = $1, task_id = $2, error = NULL, updated_at = NOW()
+		WHERE id = $3 AND status <> $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int64
+
+	err := data.WithTx(ctx, m.DB, func(tx *sql.Tx) error {
+		var err error
+		id, err = insertTask(ctx, tx, task)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.ExecContext(ctx, query, data.JobSucceeded, id, jobID)
+		if err != nil {
+			return err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected == 0 {
+			return data.JobNotUpdated(ctx, tx, `SELECT COUNT(*) FROM jobs WHERE id = $1`, jobID)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// The insertTask() helper inserts task as part of tx, along with its task.created
+// event, and returns its ID.
+func insertTask(ctx context.Context, tx *sql.Tx, task *data.Tasks) (int64, error) {
+	query := `
+		INSERT INTO tasks (title, created_by, owner_id)
+		VALUES ($1, $2, $3)
+		RETURNING id`
+
+	args := []interface{}{task.Title, task.CreatedBy, task.OwnerID}
+
+	var id int64
+
+	err := tx.QueryRowContext(ctx, query, args...).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	created := *task
+	created.ID = id
+	created.Version = 1
+
+	err = insertTaskEvent(ctx, tx, data.TopicTaskCreated, &created)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+func (m TaskModel) Get(id int64, ownerID int64) (*data.Tasks, error) {
+	if id < 1 {
+		return nil, data.ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, title, created_by, owner_id, version
+		FROM tasks
+		WHERE id = $1 AND owner_id = $2`
+
+	var task data.Tasks
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id, ownerID).Scan(
+		&task.ID,
+		&task.CreatedAt,
+		&task.Title,
+		&task.CreatedBy,
+		&task.OwnerID,
+		&task.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, data.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &task, nil
+}
+
+// GetAll uses PostgreSQL's full-text search in place of MySQL's MATCH ... AGAINST.
+func (m TaskModel) GetAll(ownerID int64, title string, createdBy string, filters data.Filters) ([]*data.Tasks, data.Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT COUNT(*) OVER(), id, created_at, title, created_by, owner_id, version
+		FROM tasks
+		WHERE owner_id = $1
+		AND (to_tsvector('simple', title) @@ plainto_tsquery('simple', $2) OR $2 = '')
+		AND (created_by = $3 OR $3 = '')
+		ORDER BY %s %s, id ASC
+		LIMIT $4 OFFSET $5`, filters.SortColumn(), filters.SortDirection())
+
+	args := []interface{}{ownerID, title, createdBy, filters.Limit(), filters.Offset()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, data.Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	tasks := []*data.Tasks{}
+
+	for rows.Next() {
+		var task data.Tasks
+
+		err := rows.Scan(
+			&totalRecords,
+			&task.ID,
+			&task.CreatedAt,
+			&task.Title,
+			&task.CreatedBy,
+			&task.OwnerID,
+			&task.Version,
+		)
+		if err != nil {
+			return nil, data.Metadata{}, err
+		}
+
+		tasks = append(tasks, &task)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, data.Metadata{}, err
+	}
+
+	metadata := data.CalculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return tasks, metadata, nil
+}
+
+func (m TaskModel) Update(task *data.Tasks) error {
+	query := `
+		UPDATE tasks
+		SET title = $1, created_by = $2, version = version + 1
+		WHERE id = $3 AND owner_id = $4 AND version = $5
+		RETURNING version`
+
+	args := []interface{}{task.Title, task.CreatedBy, task.ID, task.OwnerID, task.Version}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	updated := *task
+
+	err := data.WithTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&updated.Version)
+		if err != nil {
+			return err
+		}
+
+		return insertTaskEvent(ctx, tx, data.TopicTaskUpdated, &updated)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return data.ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	task.Version = updated.Version
+
+	return nil
+}
+
+func (m TaskModel) Delete(id int64, ownerID int64) error {
+	if id < 1 {
+		return data.ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM tasks
+		WHERE id = $1 AND owner_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return data.WithTx(ctx, m.DB, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, query, id, ownerID)
+		if err != nil {
+			return err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected == 0 {
+			return data.ErrRecordNotFound
+		}
+
+		return insertTaskEvent(ctx, tx, data.TopicTaskDeleted, &data.Tasks{ID: id, OwnerID: ownerID})
+	})
+}
+
+type JobModel struct {
+	DB *sql.DB
+}
+
+func (m JobModel) Insert(job *data.Job, message func(*data.Job) (*data.OutboxMessage, error)) error {
+	query := `
+		INSERT INTO jobs (user_id, status)
+		VALUES ($1, $2)
+		RETURNING id, created_at, updated_at, status`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := data.WithTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, query, job.UserID, data.JobPending).Scan(
+			&job.ID,
+			&job.CreatedAt,
+			&job.UpdatedAt,
+			&job.Status,
+		)
+		if err != nil {
+			return err
+		}
+
+		if message == nil {
+			return nil
+		}
+
+		msg, err := message(job)
+		if err != nil {
+			return err
+		}
+
+		return insertOutbox(ctx, tx, msg)
+	})
+	if isTemporary(err) {
+		return fmt.Errorf("%w: %s", data.ErrTemporary, err)
+	}
+
+	return err
+}
+
+func (m JobModel) Get(id int64, userID int64) (*data.Job, error) {
+	if id < 1 {
+		return nil, data.ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, updated_at, user_id, status, COALESCE(task_id, 0), COALESCE(error, '')
+		FROM jobs
+		WHERE id = $1 AND user_id = $2`
+
+	var job data.Job
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id, userID).Scan(
+		&job.ID,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+		&job.UserID,
+		&job.Status,
+		&job.TaskID,
+		&job.Error,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, data.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &job, nil
+}
+
+func (m JobModel) UpdateStatus(id int64, status string, taskID int64, errText string) error {
+	query := `
+		UPDATE jobs
+		SET status = $1, task_id = NULLIF($2, 0), error = NULLIF($3, ''), updated_at = NOW()
+		WHERE id = $4 AND (status <> $5 OR $1 = $5)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, status, taskID, errText, id, data.JobSucceeded)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return data.JobNotUpdated(ctx, m.DB, `SELECT COUNT(*) FROM jobs WHERE id = $1`, id)
+	}
+
+	return nil
+}
+
+// The insertTaskEvent() helper writes the outbox message for a change to task as part
+// of tx.
+func insertTaskEvent(ctx context.Context, tx *sql.Tx, topic string, task *data.Tasks) error {
+	msg, err := data.NewTaskEvent(topic, task)
+	if err != nil {
+		return err
+	}
+
+	return insertOutbox(ctx, tx, msg)
+}
+
+// The insertOutbox() helper writes msg to the outbox as part of tx.
+func insertOutbox(ctx context.Context, tx *sql.Tx, msg *data.OutboxMessage) error {
+	query := `
+		INSERT INTO outbox (aggregate_type, aggregate_id, topic, payload, headers)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`
+
+	args := []interface{}{msg.AggregateType, msg.AggregateID, msg.Topic, msg.Payload, msg.Headers}
+
+	return tx.QueryRowContext(ctx, query, args...).Scan(&msg.ID, &msg.CreatedAt)
+}
+
+type OutboxModel struct {
+	DB *sql.DB
+}
+
+// Relay works like the MySQL version. PostgreSQL's default isolation level is already
+// READ COMMITTED.
+func (m OutboxModel) Relay(limit int, publish func(*data.OutboxMessage) error) (int, error) {
+	return data.RelayOutbox(m.DB, data.OutboxDialect{
+		Placeholder: func(n int) string { return "$" + strconv.Itoa(n) },
+		LockRows:    "FOR UPDATE SKIP LOCKED",
+	}, limit, publish)
+}
+
+type PermissionModel struct {
+	DB *sql.DB
+}
+
+func (m PermissionModel) GetAllForUser(userID int64) (data.Permissions, error) {
+	query := `
+		SELECT permissions.code
+		FROM permissions
+		INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+		WHERE users_permissions.user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var permissions data.Permissions
+
+	for rows.Next() {
+		var permission string
+
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+// AddForUser passes the codes as a single array parameter, so the query doesn't need
+// to be built up with one placeholder per code.
+func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return addPermissions(ctx, m.DB, userID, codes)
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func addPermissions(ctx context.Context, db queryer, userID int64, codes []string) error {
+	query := `
+		INSERT INTO users_permissions (user_id, permission_id)
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+		ON CONFLICT DO NOTHING`
+
+	_, err := db.ExecContext(ctx, query, userID, pq.Array(codes))
+	return err
+}
+
+type UserModel struct {
+	DB *sql.DB
+}
+
+func (m UserModel) Insert(user *data.User) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return insertUser(ctx, m.DB, user)
+}
+
+// Register inserts a new user, grants them the given permissions and stores token for
+// them in one transaction. The token's UserID is set to the new user's ID.
+func (m UserModel) Register(user *data.User, token *data.Token, permissions ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return data.WithTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := insertUser(ctx, tx, user)
+		if err != nil {
+			return err
+		}
+
+		err = addPermissions(ctx, tx, user.ID, permissions)
+		if err != nil {
+			return err
+		}
+
+		token.UserID = user.ID
+
+		return insertToken(ctx, tx, token)
+	})
+}
+
+func insertUser(ctx context.Context, db queryer, user *data.User) error {
+	query := `
+		INSERT INTO users (name, email, password_hash, activated)
+		VALUES ($1, LOWER($2), $3, $4)
+		RETURNING id`
+
+	args := []interface{}{user.Name, user.Email, user.Password.Hash(), user.Activated}
+
+	err := db.QueryRowContext(ctx, query, args...).Scan(&user.ID)
+	if err != nil {
+		switch {
+		case isUniqueViolation(err):
+			return data.ErrDuplicateEmail
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m UserModel) Get(id int64) (*data.User, error) {
+	if id < 1 {
+		return nil, data.ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, name, email, password_hash, activated, version
+		FROM users
+		WHERE id = $1`
+
+	return m.getUser(query, id)
+}
+
+func (m UserModel) GetByEmail(email string) (*data.User, error) {
+	query := `
+		SELECT id, created_at, name, email, password_hash, activated, version
+		FROM users
+		WHERE email = LOWER($1)`
+
+	return m.getUser(query, email)
+}
+
+func (m UserModel) Update(user *data.User) error {
+	query := `
+		UPDATE users
+		SET name = $1, email = LOWER($2), password_hash = $3, activated = $4, version = version + 1
+		WHERE id = $5 AND version = $6
+		RETURNING version`
+
+	args := []interface{}{
+		user.Name,
+		user.Email,
+		user.Password.Hash(),
+		user.Activated,
+		user.ID,
+		user.Version,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+	if err != nil {
+		switch {
+		case isUniqueViolation(err):
+			return data.ErrDuplicateEmail
+		case errors.Is(err, sql.ErrNoRows):
+			return data.ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*data.User, error) {
+	query := `
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+		FROM users
+		INNER JOIN tokens
+		ON users.id = tokens.user_id
+		WHERE tokens.hash = $1
+		AND tokens.scope = $2
+		AND tokens.expiry > $3`
+
+	return m.getUser(query, data.HashToken(tokenPlaintext), tokenScope, time.Now())
+}
+
+// The getUser() method runs a query returning a single user row, in the column order
+// used by all the queries above.
+func (m UserModel) getUser(query string, args ...interface{}) (*data.User, error) {
+	var user data.User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, data.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+type TokenModel struct {
+	DB *sql.DB
+}
+
+func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*data.Token, error) {
+	return m.NewForFamily(userID, ttl, scope, nil)
+}
+
+func (m TokenModel) NewForFamily(userID int64, ttl time.Duration, scope string, family []byte) (*data.Token, error) {
+	token, err := data.GenerateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	token.Family = family
+
+	err = m.Insert(token)
+	return token, err
+}
+
+func (m TokenModel) Insert(token *data.Token) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return insertToken(ctx, m.DB, token)
+}
+
+func insertToken(ctx context.Context, db queryer, token *data.Token) error {
+	query := `
+		INSERT INTO tokens (hash, user_id, expiry, scope, family)
+		VALUES ($1, $2, $3, $4, $5)`
+
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, token.Family}
+
+	_, err := db.ExecContext(ctx, query, args...)
+	return err
+}
+
+func (m TokenModel) GetByHash(scope string, hash []byte) (*data.Token, error) {
+	query := `
+		SELECT hash, user_id, expiry, scope, family, used
+		FROM tokens
+		WHERE scope = $1 AND hash = $2 AND expiry > $3`
+
+	var token data.Token
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, scope, hash, time.Now()).Scan(
+		&token.Hash,
+		&token.UserID,
+		&token.Expiry,
+		&token.Scope,
+		&token.Family,
+		&token.Used,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, data.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &token, nil
+}
+
+func (m TokenModel) MarkUsed(scope string, hash []byte) error {
+	query := `
+		UPDATE tokens
+		SET used = TRUE
+		WHERE scope = $1 AND hash = $2 AND used = FALSE`
+
+	return m.execExpectingRow(data.ErrEditConflict, query, scope, hash)
+}
+
+func (m TokenModel) DeleteByHash(scope string, hash []byte) error {
+	query := `
+		DELETE FROM tokens
+		WHERE scope = $1 AND hash = $2`
+
+	return m.execExpectingRow(data.ErrRecordNotFound, query, scope, hash)
+}
+
+func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
+	query := `
+		DELETE FROM tokens
+		WHERE scope = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, scope, userID)
+	return err
+}
+
+func (m TokenModel) DeleteAllForFamily(scope string, family []byte) error {
+	query := `
+		DELETE FROM tokens
+		WHERE scope = $1 AND family = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, scope, family)
+	return err
+}
+
+// The execExpectingRow() method executes a statement and returns notFound if it didn't
+// affect any rows.
+func (m TokenModel) execExpectingRow(notFound error, query string, args ...interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return notFound
+	}
+
+	return nil
+}
@@ -0,0 +1,303 @@
+// Package sqlite provides a SQLite storage backend for the data models, for small
+// single-node installs and CI where running a MySQL server isn't worth it. It is
+// registered with the data package under the name "sqlite", and expects the schema
+// from migrations/sqlite.
+//
+// Most of the MySQL queries in the data package work unchanged on SQLite, so the
+// models here embed the MySQL ones and only override the methods which rely on
+// MySQL-specific SQL or error messages.
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/JacobNewton007/sendchamp-go-test/internal/data"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+func init() {
+	data.Register("sqlite", New)
+}
+
+// New returns a Models struct which uses the SQLite connection pool.
+func New(db *sql.DB) data.Models {
+	return data.Models{
+		Tasks:       TaskModel{TaskModel: data.TaskModel{DB: db}},
+		Jobs:        JobModel{JobModel: data.JobModel{DB: db}},
+		Outbox:      OutboxModel{DB: db},
+		Permissions: PermissionModel{PermissionModel: data.PermissionModel{DB: db}},
+		Users:       UserModel{UserModel: data.UserModel{DB: db}},
+		Token:       data.TokenModel{DB: db},
+	}
+}
+
+// The isBusy() helper reports whether err is SQLITE_BUSY or SQLITE_LOCKED, or one of
+// their extended codes, which mean another connection is holding a lock we need.
+func isBusy(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+
+	code := sqliteErr.Code() & 0xff
+	return code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED
+}
+
+// The isUniqueViolation() helper reports whether err was caused by a UNIQUE
+// constraint, using the SQLite extended result code rather than the error text.
+func isUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
+
+type TaskModel struct {
+	data.TaskModel
+}
+
+// GetAll replaces MySQL's MATCH ... AGAINST with a lookup in the tasks_fts FTS5 table,
+// which the triggers in the migrations keep in sync with the tasks table.
+func (m TaskModel) GetAll(ownerID int64, title string, createdBy string, filters data.Filters) ([]*data.Tasks, data.Metadata, error) {
+	// FTS5 rejects an empty MATCH expression even when the other side of an OR would
+	// make it irrelevant, so the title filter is only added when there is a title.
+	titleFilter := "AND id IN (SELECT rowid FROM tasks_fts WHERE tasks_fts MATCH ?)"
+	args := []interface{}{ownerID, ftsQuery(title)}
+
+	if strings.TrimSpace(title) == "" {
+		titleFilter = ""
+		args = args[:1]
+	}
+
+	query := fmt.Sprintf(`
+		SELECT COUNT(*) OVER(), id, created_at, title, created_by, owner_id, version
+		FROM tasks
+		WHERE owner_id = ?
+		%s
+		AND (created_by = ? OR ? = '')
+		ORDER BY %s %s, id ASC
+		LIMIT ? OFFSET ?`, titleFilter, filters.SortColumn(), filters.SortDirection())
+
+	args = append(args, createdBy, createdBy, filters.Limit(), filters.Offset())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, data.Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	tasks := []*data.Tasks{}
+
+	for rows.Next() {
+		var task data.Tasks
+
+		err := rows.Scan(
+			&totalRecords,
+			&task.ID,
+			&task.CreatedAt,
+			&task.Title,
+			&task.CreatedBy,
+			&task.OwnerID,
+			&task.Version,
+		)
+		if err != nil {
+			return nil, data.Metadata{}, err
+		}
+
+		tasks = append(tasks, &task)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, data.Metadata{}, err
+	}
+
+	metadata := data.CalculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return tasks, metadata, nil
+}
+
+// The ftsQuery() helper turns free text into an FTS5 query which matches any of the
+// words, like MySQL's natural language mode. Each word is quoted so that characters
+// with a special meaning in the FTS5 query syntax are treated literally.
+func ftsQuery(text string) string {
+	words := strings.Fields(text)
+
+	for i, word := range words {
+		words[i] = `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+	}
+
+	return strings.Join(words, " OR ")
+}
+
+type PermissionModel struct {
+	data.PermissionModel
+}
+
+// AddForUser uses INSERT OR IGNORE, SQLite's spelling of MySQL's INSERT IGNORE.
+func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return addPermissions(ctx, m.DB, userID, codes)
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func addPermissions(ctx context.Context, db queryer, userID int64, codes []string) error {
+	if len(codes) == 0 {
+		return nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(codes)), ", ")
+
+	query := `
+		INSERT OR IGNORE INTO users_permissions (user_id, permission_id)
+		SELECT ?, permissions.id FROM permissions WHERE permissions.code IN (` + placeholders + `)`
+
+	args := []interface{}{userID}
+	for _, code := range codes {
+		args = append(args, code)
+	}
+
+	_, err := db.ExecContext(ctx, query, args...)
+	return err
+}
+
+type UserModel struct {
+	data.UserModel
+}
+
+// Insert a new record in the database for the user, using RETURNING to read back the
+// system-generated id.
+func (m UserModel) Insert(user *data.User) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return insertUser(ctx, m.DB, user)
+}
+
+// Register works like the MySQL version, using the SQLite queries for the user and
+// their permissions. The token query is the same in both.
+func (m UserModel) Register(user *data.User, token *data.Token, permissions ...string) error {
+	query := `
+		INSERT INTO tokens (hash, user_id, expiry, scope, family)
+		VALUES (?, ?, ?, ?, ?)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return data.WithTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := insertUser(ctx, tx, user)
+		if err != nil {
+			return err
+		}
+
+		err = addPermissions(ctx, tx, user.ID, permissions)
+		if err != nil {
+			return err
+		}
+
+		token.UserID = user.ID
+
+		_, err = tx.ExecContext(ctx, query, token.Hash, token.UserID, token.Expiry, token.Scope, token.Family)
+		return err
+	})
+}
+
+func insertUser(ctx context.Context, db queryer, user *data.User) error {
+	query := `
+		INSERT INTO users (name, email, password_hash, activated)
+		VALUES (?, LOWER(?), ?, ?)
+		RETURNING id`
+
+	args := []interface{}{user.Name, user.Email, user.Password.Hash(), user.Activated}
+
+	err := db.QueryRowContext(ctx, query, args...).Scan(&user.ID)
+	if err != nil {
+		switch {
+		case isUniqueViolation(err):
+			return data.ErrDuplicateEmail
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Update the details for a specific user, checking the version number to prevent edit
+// conflicts and detecting duplicate emails from the SQLite result code.
+func (m UserModel) Update(user *data.User) error {
+	query := `
+		UPDATE users
+		SET name = ?, email = LOWER(?), password_hash = ?, activated = ?, version = version + 1
+		WHERE id = ? AND version = ?
+		RETURNING version`
+
+	args := []interface{}{
+		user.Name,
+		user.Email,
+		user.Password.Hash(),
+		user.Activated,
+		user.ID,
+		user.Version,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+	if err != nil {
+		switch {
+		case isUniqueViolation(err):
+			return data.ErrDuplicateEmail
+		case errors.Is(err, sql.ErrNoRows):
+			return data.ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+type JobModel struct {
+	data.JobModel
+}
+
+// Insert adds SQLite's busy errors to the ones the MySQL version wraps in
+// data.ErrTemporary.
+func (m JobModel) Insert(job *data.Job, message func(*data.Job) (*data.OutboxMessage, error)) error {
+	err := m.JobModel.Insert(job, message)
+	if isBusy(err) {
+		return fmt.Errorf("%w: %s", data.ErrTemporary, err)
+	}
+
+	return err
+}
+
+type OutboxModel struct {
+	DB *sql.DB
+}
+
+// Relay works like the MySQL version, except that it doesn't lock the rows it claims.
+// SQLite doesn't support FOR UPDATE, and doesn't need to: there is only ever one
+// server using a SQLite database, and its single connection means the transaction
+// claiming the messages can't run alongside anything else anyway.
+func (m OutboxModel) Relay(limit int, publish func(*data.OutboxMessage) error) (int, error) {
+	return data.RelayOutbox(m.DB, data.OutboxDialect{
+		Placeholder: func(int) string { return "?" },
+	}, limit, publish)
+}
@@ -0,0 +1,124 @@
+package sqlite_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/JacobNewton007/sendchamp-go-test/internal/data"
+	"github.com/JacobNewton007/sendchamp-go-test/internal/data/datatest"
+	"github.com/JacobNewton007/sendchamp-go-test/internal/data/sqlite"
+	"github.com/JacobNewton007/sendchamp-go-test/internal/migrate"
+	"github.com/JacobNewton007/sendchamp-go-test/migrations"
+)
+
+// The openDB() helper returns a connection to a new SQLite database in a temporary
+// directory, with the migrations applied.
+func openDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := "file:" + filepath.Join(t.TempDir(), "test.db") + "?_pragma=foreign_keys(1)"
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	// Like the application, use a single connection.
+	db.SetMaxOpenConns(1)
+
+	m, err := migrate.New(db, "sqlite", migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = m.Up(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func TestModels(t *testing.T) {
+	if err := datatest.TestModels(sqlite.New(openDB(t))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOutboxRelayClaims(t *testing.T) {
+	models := sqlite.New(openDB(t))
+
+	user := &data.User{Name: "Alice", Email: "alice@example.com"}
+	if err := user.Password.Set("pa55word1234"); err != nil {
+		t.Fatal(err)
+	}
+	if err := models.Users.Insert(user); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []int64
+	for _, title := range []string{"first", "second"} {
+		id, err := models.Tasks.Insert(&data.Tasks{Title: title, CreatedBy: "alice", OwnerID: user.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	// While the first relay is publishing its batch, update the first task and run a
+	// second relay. The task.updated message mustn't be published before the
+	// task.created message the first relay is holding, and nothing in the batch may be
+	// published twice.
+	var second []*data.OutboxMessage
+	nested := false
+
+	sent, err := models.Outbox.Relay(100, func(msg *data.OutboxMessage) error {
+		if nested {
+			return nil
+		}
+		nested = true
+
+		task, err := models.Tasks.Get(ids[0], user.ID)
+		if err != nil {
+			return err
+		}
+
+		task.Title = "first, updated"
+		if err := models.Tasks.Update(task); err != nil {
+			return err
+		}
+
+		_, err = models.Outbox.Relay(100, func(msg *data.OutboxMessage) error {
+			second = append(second, msg)
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sent != 2 {
+		t.Errorf("first relay sent %d messages, want 2", sent)
+	}
+	for _, msg := range second {
+		t.Errorf("second relay published %s for task %d while the first held the task", msg.Topic, msg.AggregateID)
+	}
+
+	// Once the first relay has finished, the task.updated message can go.
+	var topics []string
+	sent, err = models.Outbox.Relay(100, func(msg *data.OutboxMessage) error {
+		topics = append(topics, msg.Topic)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sent != 1 || len(topics) != 1 || topics[0] != data.TopicTaskUpdated {
+		t.Errorf("relay sent %v, want the task.updated message", topics)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/JacobNewton007/sendchamp-go-test/internal/validator"
@@ -14,6 +15,7 @@ type Tasks struct {
 	CreatedAt time.Time `json:"-"`
 	Title     string    `json:"title"`
 	CreatedBy string    `json:"created_by,omitempty"`
+	OwnerID   int64     `json:"-"`
 	Version   int32     `json:"version"`
 }
 
@@ -36,30 +38,107 @@ type TaskModel struct {
 	DB *sql.DB
 }
 
-// Add a placeholder method for inserting a new record in the movie table
+// Add a placeholder method for inserting a new record in the movie table. A
+// task.created event is written to the outbox in the same transaction.
 func (m TaskModel) Insert(task *Tasks) (int64, error) {
+	// Create a context with a 3-second timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int64
+
+	err := WithTx(ctx, m.DB, func(tx *sql.Tx) error {
+		var err error
+		id, err = insertTask(ctx, tx, task)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// InsertForJob inserts the task created by a job and marks the job as succeeded, in a
+// single transaction. If the job has already succeeded, because the message which
+// created it was delivered twice, nothing is inserted and ErrJobCompleted is
+// returned.
+func (m TaskModel) InsertForJob(task *Tasks, jobID int64) (int64, error) {
+	// The WHERE clause makes the update a no-op if the job has already succeeded. If
+	// another transaction is completing the same job, the update waits for it to
+	// finish and then sees its result.
+	query := `
+		UPDATE jobs
+		SET status = ?, task_id = ?, error = NULL, updated_at = ?
+		WHERE id = ? AND status <> ?`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int64
+
+	err := WithTx(ctx, m.DB, func(tx *sql.Tx) error {
+		var err error
+		id, err = insertTask(ctx, tx, task)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.ExecContext(ctx, query, JobSucceeded, id, time.Now().UTC(), jobID, JobSucceeded)
+		if err != nil {
+			return err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected == 0 {
+			return JobNotUpdated(ctx, tx, `SELECT COUNT(*) FROM jobs WHERE id = ?`, jobID)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// The insertTask() helper inserts task as part of tx, along with its task.created
+// event, and returns its ID.
+func insertTask(ctx context.Context, tx *sql.Tx, task *Tasks) (int64, error) {
 	// Define the SQL query for inserting a new record in
 	// the system-generated data.
 	query := `
-		INSERT INTO tasks (title, created_by)
-		VALUES (?, ?)`
+		INSERT INTO tasks (title, created_by, owner_id)
+		VALUES (?, ?, ?)`
 
 	// Create an args slice containing the values for the placeholder parameters from
-	args := []interface{}{task.Title, task.CreatedBy}
+	args := []interface{}{task.Title, task.CreatedBy, task.OwnerID}
 
-	// Create a context with a 3-second timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	result, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
 
-	// Use the QueryRow() method to execute the SQL query on our connection pool,
-	// passing in the args slice as a variadic parameter and scanning the system-
-	// generated id, created_at and version values into the task struct.
-	result, err := m.DB.ExecContext(ctx, query, args...)
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
 
+	created := *task
+	created.ID = id
+	created.Version = 1
+
+	msg, err := NewTaskEvent(TopicTaskCreated, &created)
 	if err != nil {
 		return 0, err
 	}
-	id, err := result.LastInsertId()
+
+	err = insertOutbox(ctx, tx, msg)
 	if err != nil {
 		return 0, err
 	}
@@ -67,17 +146,40 @@ func (m TaskModel) Insert(task *Tasks) (int64, error) {
 	return id, nil
 }
 
-// Add a placeholder method for fetching a specfic record in the movie table
-func (m TaskModel) Get(id int64) (*Tasks, error) {
+// JobNotUpdated works out why an update to a job didn't match any rows, using query to
+// count the jobs with the ID. It returns ErrRecordNotFound if the job doesn't exist,
+// and ErrJobCompleted if it has already succeeded. It's shared by the SQL backends, and
+// db may be a *sql.DB or a *sql.Tx.
+func JobNotUpdated(ctx context.Context, db interface {
+	QueryRowContext(context.Context, string, ...interface{}) *sql.Row
+}, query string, jobID int64) error {
+	var count int
+
+	err := db.QueryRowContext(ctx, query, jobID).Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return ErrRecordNotFound
+	}
+
+	return ErrJobCompleted
+}
+
+// Add a placeholder method for fetching a specfic record in the movie table. The
+// ownerID argument scopes the lookup, so a task belonging to another user is reported
+// as ErrRecordNotFound.
+func (m TaskModel) Get(id int64, ownerID int64) (*Tasks, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 
 	// Define the SQL query for retrieving the movie data.
 	query := `
-					SELECT id, created_at, title, created_by, version
+					SELECT id, created_at, title, created_by, owner_id, version
 					FROM tasks
-					WHERE id = ?
+					WHERE id = ? AND owner_id = ?
 					`
 	// Declare a Task struct to hold the data returned by the query.
 	var task Tasks
@@ -92,11 +194,12 @@ func (m TaskModel) Get(id int64) (*Tasks, error) {
 	// as a placeholder parameter, and scan the response data into the fields of the
 	// Task struct. Importantly, notice that we need to convert the scan target for the
 
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+	err := m.DB.QueryRowContext(ctx, query, id, ownerID).Scan(
 		&task.ID,
 		&task.CreatedAt,
 		&task.Title,
 		&task.CreatedBy,
+		&task.OwnerID,
 		&task.Version,
 	)
 
@@ -115,20 +218,88 @@ func (m TaskModel) Get(id int64) (*Tasks, error) {
 	return &task, nil
 }
 
-// Add a placeholder method for updating a specific record in the task table
+// GetAll returns a slice of the owner's tasks matching the title and created_by
+// filters, along with the pagination metadata for the listing.
+func (m TaskModel) GetAll(ownerID int64, title string, createdBy string, filters Filters) ([]*Tasks, Metadata, error) {
+	// Construct the SQL query to retrieve all task records. The MATCH ... AGAINST clause
+	// performs a full-text search on the title (using the tasks_title_idx index) and
+	// the window function counts the total number of filtered records so that we can
+	// calculate the pagination metadata in a single round-trip. The sort column and
+	// direction have already been checked against the safelist, so it's safe to
+	// interpolate them here.
+	query := fmt.Sprintf(`
+		SELECT COUNT(*) OVER(), id, created_at, title, created_by, owner_id, version
+		FROM tasks
+		WHERE owner_id = ?
+		AND (MATCH(title) AGAINST(? IN NATURAL LANGUAGE MODE) OR ? = '')
+		AND (created_by = ? OR ? = '')
+		ORDER BY %s %s, id ASC
+		LIMIT ? OFFSET ?`, filters.SortColumn(), filters.SortDirection())
+
+	args := []interface{}{ownerID, title, title, createdBy, createdBy, filters.Limit(), filters.Offset()}
+
+	// Create a context with a 3-second timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	// Importantly, defer a call to rows.Close() to ensure that the resultset is closed
+	// before GetAll() returns.
+	defer rows.Close()
+
+	totalRecords := 0
+	tasks := []*Tasks{}
+
+	for rows.Next() {
+		var task Tasks
+
+		err := rows.Scan(
+			&totalRecords,
+			&task.ID,
+			&task.CreatedAt,
+			&task.Title,
+			&task.CreatedBy,
+			&task.OwnerID,
+			&task.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		tasks = append(tasks, &task)
+	}
+
+	// When the rows.Next() loop has finished, call rows.Err() to retrieve any error
+	// that was encountered during the iteration.
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := CalculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return tasks, metadata, nil
+}
+
+// Add a placeholder method for updating a specific record in the task table. A
+// task.updated event is written to the outbox in the same transaction.
 func (m TaskModel) Update(task *Tasks) error {
-	// Declare the SQL query for updating the record and returning the new version numer
+	// Declare the SQL query for updating the record. MySQL doesn't support RETURNING,
+	// so we bump the version number on the struct ourselves once the update succeeds.
 	query := `
 					UPDATE tasks
 					SET title = ?, created_by = ?, version = version + 1
-					WHERE id = ? AND version = ?
-					RETURNING version
+					WHERE id = ? AND owner_id = ? AND version = ?
 					`
 	// Create an args slice containing the value for the placeholder parameters.
 	args := []interface{}{
 		task.Title,
 		task.CreatedBy,
 		task.ID,
+		task.OwnerID,
 		task.Version,
 	}
 
@@ -136,23 +307,47 @@ func (m TaskModel) Update(task *Tasks) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	// Use the QueryRow() method to execute the query, passing in the args slice as a
-	// variadic parameter and scanning the new version value into the task struct.
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&task.Version)
-	if err != nil {
-		switch {
-		case errors.Is(err, sql.ErrNoRows):
+	updated := *task
+	updated.Version++
+
+	err := WithTx(ctx, m.DB, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+
+		// If no rows were affected, then either the task has been deleted or its
+		// version number has changed since we read it. Either way it's an edit
+		// conflict.
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected == 0 {
 			return ErrEditConflict
-		default:
+		}
+
+		msg, err := NewTaskEvent(TopicTaskUpdated, &updated)
+		if err != nil {
 			return err
 		}
+
+		return insertOutbox(ctx, tx, msg)
+	})
+	if err != nil {
+		return err
 	}
 
+	task.Version = updated.Version
+
 	return nil
 }
 
-// Add a placeholder method for deleting a specific record in the task table
-func (m TaskModel) Delete(id int64) error {
+// Add a placeholder method for deleting a specific record in the task table. As with
+// Get(), only the owner of the task can delete it. A task.deleted event is written to
+// the outbox in the same transaction.
+func (m TaskModel) Delete(id int64, ownerID int64) error {
 	// Return an ErrRecordNotFound error if the task ID is less than 1
 	if id < 1 {
 		return ErrRecordNotFound
@@ -160,31 +355,35 @@ func (m TaskModel) Delete(id int64) error {
 
 	// Construct the SQL query to delete the record
 	query := `
-					DELETE FROM tasks 
-					WHERE id = ?
+					DELETE FROM tasks
+					WHERE id = ? AND owner_id = ?
 					`
 	// Create a context with a 3-second timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	// Execute the SQL query using the Exec() method, passing in the id variable as
-	// the valur for the placeholder parameter. The Exec method returns a sql.Result
-	// object.
-	result, err := m.DB.ExecContext(ctx, query, id)
-	if err != nil {
-		return err
-	}
 
-	// Call the RowsAffected method on the sql.Result object to get the number of rows
-	// affected by the query.
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return err
-	}
-	// If no rows were affected, we know that the task table didn't contain a record // with the provided ID at the moment we tried to delete it. In that case we
-	// return an ErrRecordNotFound error.
-	if rowsAffected == 0 {
-		return ErrRecordNotFound
-	}
+	return WithTx(ctx, m.DB, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, query, id, ownerID)
+		if err != nil {
+			return err
+		}
 
-	return nil
+		// If no rows were affected, the task table didn't contain a record with the
+		// provided ID (for this owner) at the moment we tried to delete it.
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected == 0 {
+			return ErrRecordNotFound
+		}
+
+		msg, err := NewTaskEvent(TopicTaskDeleted, &Tasks{ID: id, OwnerID: ownerID})
+		if err != nil {
+			return err
+		}
+
+		return insertOutbox(ctx, tx, msg)
+	})
 }
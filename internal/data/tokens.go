@@ -6,7 +6,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
-	"fmt"
+	"errors"
 	"time"
 
 	"github.com/JacobNewton007/sendchamp-go-test/internal/validator"
@@ -18,6 +18,8 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopePasswordReset  = "password-reset"
+	ScopeRefresh        = "refresh"
 )
 
 type Token struct {
@@ -26,9 +28,12 @@ type Token struct {
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	Family    []byte    `json:"-"`
+	Used      bool      `json:"-"`
 }
 
-func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
+// GenerateToken creates a new random token, without storing it anywhere.
+func GenerateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
 
 	token := &Token{
 		UserID: userID,
@@ -46,12 +51,18 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 
 	token.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
 
-	hash := sha256.Sum256([]byte(token.Plaintext))
-	token.Hash = hash[:]
+	token.Hash = HashToken(token.Plaintext)
 
 	return token, nil
 }
 
+// HashToken returns the SHA-256 hash of a plaintext token, which is what we store in
+// the tokens table.
+func HashToken(tokenPlaintext string) []byte {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	return hash[:]
+}
+
 func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 	v.Check(tokenPlaintext != "", "token", "must be provided")
 	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
@@ -65,27 +76,57 @@ type TokenModel struct {
 // The New() method is a shortcut which creates a new Token struct and then inserts the
 // data in the tokens table.
 func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
-	token, err := generateToken(userID, ttl, scope)
+	token, err := GenerateToken(userID, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
 
-	fmt.Println("token ::::::::", token)
 	err = m.Insert(token)
 	return token, err
 }
 
-func (m TokenModel) Insert(token *Token) error {
-	query := `
-		INSERT INTO tokens (hash, user_id, expiry, scope)
-		VALUES (?, ?, ?, ?)
-	`
-	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
+// NewFamily generates the random identifier shared by an access token and the chain of
+// refresh tokens which are rotated from it.
+func NewFamily() ([]byte, error) {
+	family := make([]byte, 16)
+
+	_, err := rand.Read(family)
+	if err != nil {
+		return nil, err
+	}
+
+	return family, nil
+}
+
+// The NewForFamily() method works like New(), but links the token to a token family
+// so that the whole family can be revoked together.
+func (m TokenModel) NewForFamily(userID int64, ttl time.Duration, scope string, family []byte) (*Token, error) {
+	token, err := GenerateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	token.Family = family
+
+	err = m.Insert(token)
+	return token, err
+}
 
+func (m TokenModel) Insert(token *Token) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, args...)
+	return insertToken(ctx, m.DB, token)
+}
+
+func insertToken(ctx context.Context, db execer, token *Token) error {
+	query := `
+		INSERT INTO tokens (hash, user_id, expiry, scope, family)
+		VALUES (?, ?, ?, ?, ?)
+	`
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, token.Family}
+
+	_, err := db.ExecContext(ctx, query, args...)
 	return err
 }
 
@@ -100,3 +141,105 @@ func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 	return err
 }
+
+// DeleteByHash deletes a single token with the given scope and hash. It returns
+// ErrRecordNotFound if there was no such token.
+func (m TokenModel) DeleteByHash(scope string, hash []byte) error {
+	query := `
+		DELETE FROM tokens
+		WHERE scope = ? AND hash = ?
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, scope, hash)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetByHash fetches an unexpired token with the given scope and hash, including tokens
+// which have already been used. It returns ErrRecordNotFound if there is no such token.
+func (m TokenModel) GetByHash(scope string, hash []byte) (*Token, error) {
+	query := `
+		SELECT hash, user_id, expiry, scope, family, used
+		FROM tokens
+		WHERE scope = ? AND hash = ? AND expiry > ?
+	`
+	var token Token
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, scope, hash, time.Now()).Scan(
+		&token.Hash,
+		&token.UserID,
+		&token.Expiry,
+		&token.Scope,
+		&token.Family,
+		&token.Used,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &token, nil
+}
+
+// MarkUsed flags a token as used. The update only matches tokens which haven't been
+// used yet, so if two requests race to use the same token only one of them succeeds
+// and the other gets ErrEditConflict.
+func (m TokenModel) MarkUsed(scope string, hash []byte) error {
+	query := `
+		UPDATE tokens
+		SET used = 1
+		WHERE scope = ? AND hash = ? AND used = 0
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, scope, hash)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
+
+// DeleteAllForFamily deletes every token with the given scope in a token family.
+func (m TokenModel) DeleteAllForFamily(scope string, family []byte) error {
+	query := `
+		DELETE FROM tokens
+		WHERE scope = ? AND family = ?
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, scope, family)
+	return err
+}
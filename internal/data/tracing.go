@@ -0,0 +1,269 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/JacobNewton007/sendchamp-go-test/internal/data"
+
+// Traced returns a copy of the models which records an OpenTelemetry span for every
+// method call, as a child of the span in ctx. The store interfaces don't take a
+// context, so handlers call this with the request context to tie the spans to the
+// request. When tracing is disabled the spans are no-ops.
+func (m Models) Traced(ctx context.Context) Models {
+	t := tracer{ctx: ctx, tracer: otel.Tracer(tracerName)}
+
+	return Models{
+		Tasks:       tracedTasks{t, m.Tasks},
+		Jobs:        tracedJobs{t, m.Jobs},
+		Outbox:      tracedOutbox{t, m.Outbox},
+		Permissions: tracedPermissions{t, m.Permissions},
+		Users:       tracedUsers{t, m.Users},
+		Token:       tracedTokens{t, m.Token},
+	}
+}
+
+type tracer struct {
+	ctx    context.Context
+	tracer trace.Tracer
+}
+
+func (t tracer) start(name string) trace.Span {
+	_, span := t.tracer.Start(t.ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+	return span
+}
+
+// The end() helper ends a span, recording err on it. The errors defined in this
+// package are expected outcomes rather than failures, so they don't mark the span as
+// failed.
+func end(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+
+		switch {
+		case errors.Is(err, ErrRecordNotFound), errors.Is(err, ErrEditConflict), errors.Is(err, ErrDuplicateEmail), errors.Is(err, ErrJobCompleted):
+		default:
+			span.SetStatus(codes.Error, err.Error())
+		}
+	}
+
+	span.End()
+}
+
+type tracedTasks struct {
+	tracer
+	next TaskStore
+}
+
+func (t tracedTasks) Insert(task *Tasks) (int64, error) {
+	span := t.start("TaskStore.Insert")
+	id, err := t.next.Insert(task)
+	end(span, err)
+	return id, err
+}
+
+func (t tracedTasks) InsertForJob(task *Tasks, jobID int64) (int64, error) {
+	span := t.start("TaskStore.InsertForJob")
+	id, err := t.next.InsertForJob(task, jobID)
+	end(span, err)
+	return id, err
+}
+
+func (t tracedTasks) Get(id int64, ownerID int64) (*Tasks, error) {
+	span := t.start("TaskStore.Get")
+	task, err := t.next.Get(id, ownerID)
+	end(span, err)
+	return task, err
+}
+
+func (t tracedTasks) GetAll(ownerID int64, title string, createdBy string, filters Filters) ([]*Tasks, Metadata, error) {
+	span := t.start("TaskStore.GetAll")
+	tasks, metadata, err := t.next.GetAll(ownerID, title, createdBy, filters)
+	end(span, err)
+	return tasks, metadata, err
+}
+
+func (t tracedTasks) Update(task *Tasks) error {
+	span := t.start("TaskStore.Update")
+	err := t.next.Update(task)
+	end(span, err)
+	return err
+}
+
+func (t tracedTasks) Delete(id int64, ownerID int64) error {
+	span := t.start("TaskStore.Delete")
+	err := t.next.Delete(id, ownerID)
+	end(span, err)
+	return err
+}
+
+type tracedJobs struct {
+	tracer
+	next JobStore
+}
+
+func (t tracedJobs) Insert(job *Job, message func(*Job) (*OutboxMessage, error)) error {
+	span := t.start("JobStore.Insert")
+	err := t.next.Insert(job, message)
+	end(span, err)
+	return err
+}
+
+func (t tracedJobs) Get(id int64, userID int64) (*Job, error) {
+	span := t.start("JobStore.Get")
+	job, err := t.next.Get(id, userID)
+	end(span, err)
+	return job, err
+}
+
+func (t tracedJobs) UpdateStatus(id int64, status string, taskID int64, errText string) error {
+	span := t.start("JobStore.UpdateStatus")
+	err := t.next.UpdateStatus(id, status, taskID, errText)
+	end(span, err)
+	return err
+}
+
+type tracedOutbox struct {
+	tracer
+	next OutboxStore
+}
+
+func (t tracedOutbox) Relay(limit int, publish func(*OutboxMessage) error) (int, error) {
+	span := t.start("OutboxStore.Relay")
+	sent, err := t.next.Relay(limit, publish)
+	end(span, err)
+	return sent, err
+}
+
+type tracedPermissions struct {
+	tracer
+	next PermissionStore
+}
+
+func (t tracedPermissions) GetAllForUser(userID int64) (Permissions, error) {
+	span := t.start("PermissionStore.GetAllForUser")
+	permissions, err := t.next.GetAllForUser(userID)
+	end(span, err)
+	return permissions, err
+}
+
+func (t tracedPermissions) AddForUser(userID int64, codes ...string) error {
+	span := t.start("PermissionStore.AddForUser")
+	err := t.next.AddForUser(userID, codes...)
+	end(span, err)
+	return err
+}
+
+type tracedUsers struct {
+	tracer
+	next UserStore
+}
+
+func (t tracedUsers) Insert(user *User) error {
+	span := t.start("UserStore.Insert")
+	err := t.next.Insert(user)
+	end(span, err)
+	return err
+}
+
+func (t tracedUsers) Register(user *User, token *Token, permissions ...string) error {
+	span := t.start("UserStore.Register")
+	err := t.next.Register(user, token, permissions...)
+	end(span, err)
+	return err
+}
+
+func (t tracedUsers) Get(id int64) (*User, error) {
+	span := t.start("UserStore.Get")
+	user, err := t.next.Get(id)
+	end(span, err)
+	return user, err
+}
+
+func (t tracedUsers) GetByEmail(email string) (*User, error) {
+	span := t.start("UserStore.GetByEmail")
+	user, err := t.next.GetByEmail(email)
+	end(span, err)
+	return user, err
+}
+
+func (t tracedUsers) Update(user *User) error {
+	span := t.start("UserStore.Update")
+	err := t.next.Update(user)
+	end(span, err)
+	return err
+}
+
+func (t tracedUsers) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+	span := t.start("UserStore.GetForToken")
+	user, err := t.next.GetForToken(tokenScope, tokenPlaintext)
+	end(span, err)
+	return user, err
+}
+
+type tracedTokens struct {
+	tracer
+	next TokenStore
+}
+
+func (t tracedTokens) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+	span := t.start("TokenStore.New")
+	token, err := t.next.New(userID, ttl, scope)
+	end(span, err)
+	return token, err
+}
+
+func (t tracedTokens) NewForFamily(userID int64, ttl time.Duration, scope string, family []byte) (*Token, error) {
+	span := t.start("TokenStore.NewForFamily")
+	token, err := t.next.NewForFamily(userID, ttl, scope, family)
+	end(span, err)
+	return token, err
+}
+
+func (t tracedTokens) Insert(token *Token) error {
+	span := t.start("TokenStore.Insert")
+	err := t.next.Insert(token)
+	end(span, err)
+	return err
+}
+
+func (t tracedTokens) GetByHash(scope string, hash []byte) (*Token, error) {
+	span := t.start("TokenStore.GetByHash")
+	token, err := t.next.GetByHash(scope, hash)
+	end(span, err)
+	return token, err
+}
+
+func (t tracedTokens) MarkUsed(scope string, hash []byte) error {
+	span := t.start("TokenStore.MarkUsed")
+	err := t.next.MarkUsed(scope, hash)
+	end(span, err)
+	return err
+}
+
+func (t tracedTokens) DeleteByHash(scope string, hash []byte) error {
+	span := t.start("TokenStore.DeleteByHash")
+	err := t.next.DeleteByHash(scope, hash)
+	end(span, err)
+	return err
+}
+
+func (t tracedTokens) DeleteAllForUser(scope string, userID int64) error {
+	span := t.start("TokenStore.DeleteAllForUser")
+	err := t.next.DeleteAllForUser(scope, userID)
+	end(span, err)
+	return err
+}
+
+func (t tracedTokens) DeleteAllForFamily(scope string, family []byte) error {
+	span := t.start("TokenStore.DeleteAllForFamily")
+	err := t.next.DeleteAllForFamily(scope, family)
+	end(span, err)
+	return err
+}
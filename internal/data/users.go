@@ -2,13 +2,13 @@ package data
 
 import (
 	"context"
-	"crypto/sha256"
 	"database/sql"
 	"errors"
 	"fmt"
 	"time"
 
 	"github.com/JacobNewton007/sendchamp-go-test/internal/validator"
+	"github.com/go-sql-driver/mysql"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -33,6 +33,26 @@ type password struct {
 	hash      []byte
 }
 
+// Hash returns the bcrypt hash of the password. It's used by storage backends outside
+// this package which need to persist it.
+func (p *password) Hash() []byte {
+	return p.hash
+}
+
+// Scan implements the sql.Scanner interface, so that storage backends outside this
+// package can scan a password_hash column straight into a User's Password field.
+func (p *password) Scan(src interface{}) error {
+	hash, ok := src.([]byte)
+	if !ok {
+		return fmt.Errorf("cannot scan %T into password hash", src)
+	}
+
+	p.plaintext = nil
+	p.hash = append([]byte(nil), hash...)
+
+	return nil
+}
+
 func (u *User) IsAnonymous() bool {
 	return u == AnonymousUser
 }
@@ -107,26 +127,60 @@ type UserModel struct {
 }
 
 // Insert a new record in the database for the user. Note that the id, created_at and
-// version fields are all automatically generated by our database, so we use the
-// RETURNING clause to read them into the User struct after the insert,
+// version fields are all automatically generated by our database, and we read the id
+// back into the User struct after the insert.
 func (m UserModel) Insert(user *User) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return insertUser(ctx, m.DB, user)
+}
+
+// Register inserts a new user, grants them the given permissions and stores token for
+// them, all in one transaction, so that a failure part way through doesn't leave behind
+// an account which can't be activated. The token's UserID is set to the new user's ID.
+func (m UserModel) Register(user *User, token *Token, permissions ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return WithTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := insertUser(ctx, tx, user)
+		if err != nil {
+			return err
+		}
+
+		err = addPermissions(ctx, tx, user.ID, permissions)
+		if err != nil {
+			return err
+		}
+
+		token.UserID = user.ID
+
+		return insertToken(ctx, tx, token)
+	})
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx, so that the helpers which take one
+// can be used inside and outside of a transaction.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertUser(ctx context.Context, db execer, user *User) error {
 	query := `
 		INSERT INTO users (name, email, password_hash, activated)
 		VALUES (?, LOWER(?), ?, ?)
 		`
 	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
 	// If the table already contains a record with this email address, then when we try
 	// to perform the insert there will be a violation of the UNIQUE "users_email_key"
 	// constraint that we set up in the previous chapter. We check for this error
 	// specifically, and return custom ErrDuplicateEmail error instead.
-	result, err := m.DB.ExecContext(ctx, query, args...)
+	result, err := db.ExecContext(ctx, query, args...)
 	if err != nil {
 		switch {
-		case err.Error() == fmt.Sprintf("Error 1062: Duplicate entry '%s' for key 'users.email'", user.Email):
+		case isDuplicateEntry(err):
 			return ErrDuplicateEmail
 		default:
 			return err
@@ -141,6 +195,13 @@ func (m UserModel) Insert(user *User) error {
 		return ErrRecordNotFound
 	}
 
+	// MySQL doesn't support RETURNING, so read the system-generated id back from the
+	// result instead. Callers rely on it to issue tokens and permissions.
+	user.ID, err = result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -149,7 +210,7 @@ func (m UserModel) Insert(user *User) error {
 // return one record (or none at all, in which case we return a ErrRecordNotFound error).
 func (m UserModel) GetByEmail(email string) (*User, error) {
 	query := `
-		SELECT id, name, password_hash, activated, version
+		SELECT id, created_at, name, email, password_hash, activated, version
 		FROM users
 		WHERE email = LOWER(?)
 		`
@@ -158,6 +219,8 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 	defer cancel()
 	err := m.DB.QueryRowContext(ctx, query, email).Scan(
 		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
@@ -176,6 +239,43 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
+// Retrieve the User details from the database based on the user's ID.
+func (m UserModel) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, name, email, password_hash, activated, version
+		FROM users
+		WHERE id = ?
+		`
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
 // Update the details for a specific user. Notice that we check against the version
 // field to help prevent any race conditions during the request cycle, just like we did
 // when updating a movie. And we also check for a violation of the "users_email_key"
@@ -185,8 +285,7 @@ func (m UserModel) Update(user *User) error {
 	query := `
 		UPDATE users
 		SET name = ?, email = LOWER(?), password_hash = ?, activated = ?, version = version + 1
-		WHERE id = ? AND version = ?
-		RETURNING version`
+		WHERE id = ? AND version = ?`
 
 	args := []interface{}{
 		user.Name,
@@ -200,24 +299,40 @@ func (m UserModel) Update(user *User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+	result, err := m.DB.ExecContext(ctx, query, args...)
 	if err != nil {
 		switch {
-		case err.Error() == `pq: duplicate key value violates unique contraint "user_email_key"`:
+		case isDuplicateEntry(err):
 			return ErrDuplicateEmail
-		case errors.Is(err, sql.ErrNoRows):
-			return ErrEditConflict
 		default:
 			return err
 		}
 	}
 
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	user.Version++
+
 	return nil
 }
 
+// The isDuplicateEntry() helper reports whether err is a MySQL ER_DUP_ENTRY error,
+// which is returned when an insert or update violates a UNIQUE constraint.
+func isDuplicateEntry(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
+
 func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
 
-	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	tokenHash := HashToken(tokenPlaintext)
 
 	query := `
 		SELECT users.id, users.name, users.email, users.password_hash, users.activated, users.version
@@ -228,7 +343,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		AND tokens.scope = ?
 		AND tokens.expiry > ?
 	`
-	args := []interface{}{tokenHash[:], tokenScope, time.Now()}
+	args := []interface{}{tokenHash, tokenScope, time.Now()}
 
 	var user User
 
@@ -2,17 +2,22 @@ package jsonlog
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Level int8
 
 const (
-	LevelInfo Level = iota
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
 	LevelError
 	LevelFatal
 	LevelOff
@@ -20,62 +25,152 @@ const (
 
 func (l Level) String() string {
 	switch l {
+	case LevelDebug:
+		return "DEBUG"
 	case LevelInfo:
 		return "INFO"
+	case LevelWarn:
+		return "WARN"
 	case LevelError:
 		return "ERROR"
 	case LevelFatal:
 		return "FATAL"
+	case LevelOff:
+		return "OFF"
 	default:
 		return ""
 	}
 }
 
+// ParseLevel converts a level name such as "debug" or "WARN" into a Level.
+func ParseLevel(s string) (Level, error) {
+	for l := LevelDebug; l <= LevelOff; l++ {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+
+	return LevelOff, fmt.Errorf("unknown log level %q", s)
+}
+
+// Fields holds the additional properties for a log entry. Values can be of any type
+// which encoding/json understands. Errors and time.Duration values are written out
+// as their string forms, which are far more useful to a human than what encoding/json
+// would make of them.
+type Fields map[string]interface{}
+
+// LevelWriter is implemented by outputs which treat entries differently depending on
+// their level, like Syslog. The Logger calls WriteLevel() instead of Write() on them.
+type LevelWriter interface {
+	io.Writer
+	WriteLevel(level Level, p []byte) (int, error)
+}
+
+// The output struct is shared by a logger and all the child loggers created from it
+// with With(), so that they write to the same place, use the same mutex, and all see
+// changes to the minimum level.
+type output struct {
+	out         io.Writer
+	mu          sync.Mutex
+	minLevel    int32
+	stackTraces int32
+}
+
+// Logger writes JSON log entries. Besides the shared output it holds the fields which
+// are added to every entry it writes.
 type Logger struct {
-	out      io.Writer
-	minLevel Level
-	mu       sync.Mutex
+	*output
+	fields Fields
 }
 
+// New returns a Logger which writes entries at or above minLevel to out. Stack traces
+// are off until enabled with SetStackTraces().
 func New(out io.Writer, minLevel Level) *Logger {
 	return &Logger{
-		out:      out,
-		minLevel: minLevel,
+		output: &output{
+			out:      out,
+			minLevel: int32(minLevel),
+		},
+	}
+}
+
+// The With() method returns a child logger which adds fields to every entry it writes,
+// on top of any added by its parent. It's used to carry context like a request or job
+// ID through code which doesn't otherwise know about it.
+func (l *Logger) With(fields Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+
+	return &Logger{output: l.output, fields: merged}
+}
+
+// The SetLevel() method changes the minimum severity level at runtime. The change
+// applies to the logger, its parent and all their child loggers.
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(&l.minLevel, int32(level))
+}
+
+// The Level() method returns the current minimum severity level.
+func (l *Logger) Level() Level {
+	return Level(atomic.LoadInt32(&l.minLevel))
+}
+
+// The SetStackTraces() method controls whether ERROR and FATAL entries include a
+// stack trace. They're off by default, as they make the logs much larger and are
+// rarely needed outside of development.
+func (l *Logger) SetStackTraces(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
 	}
+	atomic.StoreInt32(&l.stackTraces, v)
 }
 
-func (l *Logger) PrintInfo(message string, properties map[string]string) {
+func (l *Logger) PrintDebug(message string, properties Fields) {
+	l.print(LevelDebug, message, properties)
+}
+
+func (l *Logger) PrintInfo(message string, properties Fields) {
 	l.print(LevelInfo, message, properties)
 }
 
-func (l *Logger) PrintError(err error, properties map[string]string) {
+func (l *Logger) PrintWarn(message string, properties Fields) {
+	l.print(LevelWarn, message, properties)
+}
+
+func (l *Logger) PrintError(err error, properties Fields) {
 	l.print(LevelError, err.Error(), properties)
 }
 
-func (l *Logger) PrintFatal(err error, properties map[string]string) {
+func (l *Logger) PrintFatal(err error, properties Fields) {
 	l.print(LevelFatal, err.Error(), properties)
 	os.Exit(1)
 }
 
-func (l *Logger) print(level Level, message string, properties map[string]string) (int, error) {
-	if level < l.minLevel {
+func (l *Logger) print(level Level, message string, properties Fields) (int, error) {
+	if level < l.Level() {
 		return 0, nil
 	}
 
 	aux := struct {
-		Level      string            `json:"level"`
-		Time       string            `json:"time"`
-		Message    string            `json:"message"`
-		Properties map[string]string `json:"properties,omitempty"`
-		Trace      string            `json:"trace,omitempty"`
+		Level      string                 `json:"level"`
+		Time       string                 `json:"time"`
+		Message    string                 `json:"message"`
+		Properties map[string]interface{} `json:"properties,omitempty"`
+		Trace      string                 `json:"trace,omitempty"`
 	}{
 		Level:      level.String(),
 		Time:       time.Now().UTC().Format(time.RFC3339),
 		Message:    message,
-		Properties: properties,
+		Properties: l.properties(properties),
 	}
 
-	if level >= LevelError {
+	if level >= LevelError && atomic.LoadInt32(&l.stackTraces) == 1 {
 		aux.Trace = string(debug.Stack())
 	}
 
@@ -89,9 +184,38 @@ func (l *Logger) print(level Level, message string, properties map[string]string
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	if lw, ok := l.out.(LevelWriter); ok {
+		return lw.WriteLevel(level, append(line, '\n'))
+	}
+
 	return l.out.Write(append(line, '\n'))
 }
 
+// The properties() method merges the logger's own fields with those for a single
+// entry, converting the values which encoding/json handles badly.
+func (l *Logger) properties(properties Fields) map[string]interface{} {
+	if len(l.fields) == 0 && len(properties) == 0 {
+		return nil
+	}
+
+	merged := make(map[string]interface{}, len(l.fields)+len(properties))
+
+	for _, fields := range []Fields{l.fields, properties} {
+		for k, v := range fields {
+			switch v := v.(type) {
+			case error:
+				merged[k] = v.Error()
+			case time.Duration:
+				merged[k] = v.String()
+			default:
+				merged[k] = v
+			}
+		}
+	}
+
+	return merged
+}
+
 func (l *Logger) Write(message []byte) (n int, err error) {
 	return l.print(LevelError, string(message), nil)
 }
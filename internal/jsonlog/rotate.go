@@ -0,0 +1,324 @@
+package jsonlog
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RotateOptions controls when a RotatingFile is rotated and what happens to the old
+// files. A zero value for any of the limits disables it.
+type RotateOptions struct {
+	// MaxSize is the size in bytes the file may grow to before it is rotated.
+	MaxSize int64
+	// MaxAge is how long a file is written to before it is rotated.
+	MaxAge time.Duration
+	// MaxBackups is the number of rotated files to keep. Older ones are deleted.
+	MaxBackups int
+	// Compress gzips rotated files.
+	Compress bool
+}
+
+// RotatingFile is an io.Writer which appends to a log file and rotates it when it gets
+// too big or too old, or when Rotate() is called. Rotated files are renamed with a
+// timestamp, so "api.log" becomes something like "api-20230102T150405.000.log".
+//
+// It is safe for concurrent use. The Logger already serializes its writes, but
+// Rotate() is usually called from a signal handler in a different goroutine.
+type RotatingFile struct {
+	path string
+	opts RotateOptions
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+
+	// lastBackup is the timestamp in the name of the most recently rotated file.
+	lastBackup time.Time
+
+	// pending holds the rotated files waiting to be compressed and pruned by the
+	// worker goroutine. Doing both on a single goroutine means that pruning can never
+	// delete a file while it is being compressed.
+	pending []string
+	wake    chan struct{}
+
+	closeOnce sync.Once
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+// OpenFile opens the log file at path for appending, creating it if necessary.
+func OpenFile(path string, opts RotateOptions) (*RotatingFile, error) {
+	f := &RotatingFile{
+		path:    path,
+		opts:    opts,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	err := f.open()
+	if err != nil {
+		return nil, err
+	}
+
+	go f.work()
+
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+
+	return nil
+}
+
+// Write writes p to the current file, rotating it first if the write would take it
+// over the size limit or the file has reached its maximum age.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	tooBig := f.opts.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.opts.MaxSize
+	tooOld := f.opts.MaxAge > 0 && time.Since(f.opened) >= f.opts.MaxAge
+
+	if tooBig || tooOld {
+		err := f.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	return n, err
+}
+
+// Rotate closes the current file, renames it and starts a new one.
+func (f *RotatingFile) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return os.ErrClosed
+	}
+
+	return f.rotate()
+}
+
+func (f *RotatingFile) rotate() error {
+	err := f.file.Close()
+	if err != nil {
+		return err
+	}
+	f.file = nil
+
+	backup := f.backupName(time.Now())
+
+	renameErr := os.Rename(f.path, backup)
+
+	// Whatever happened to the old file, make sure we have one to write to, so that
+	// log entries aren't lost.
+	err = f.open()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case os.IsNotExist(renameErr):
+		// The file was removed from under us, so there's nothing to compress.
+		return nil
+	case renameErr != nil:
+		return renameErr
+	}
+
+	// Compressing a large file takes a while, so hand it (and the pruning, which has
+	// to happen after compression has renamed the file) to the worker goroutine.
+	f.pending = append(f.pending, backup)
+
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// The backupName() method returns the name to rename the current file to when rotating
+// it at time t. The names have millisecond resolution, so if the file was last rotated
+// within the same millisecond, or a file with the name already exists, the timestamp
+// is moved on by a millisecond until it is unique. Later files always sort after
+// earlier ones, which prune() relies on.
+func (f *RotatingFile) backupName(t time.Time) string {
+	ext := filepath.Ext(f.path)
+	base := strings.TrimSuffix(f.path, ext)
+
+	t = t.UTC().Truncate(time.Millisecond)
+	if !t.After(f.lastBackup) {
+		t = f.lastBackup.Add(time.Millisecond)
+	}
+
+	for {
+		name := fmt.Sprintf("%s-%s%s", base, t.Format("20060102T150405.000"), ext)
+
+		if !fileExists(name) && !fileExists(name+".gz") {
+			f.lastBackup = t
+			return name
+		}
+
+		t = t.Add(time.Millisecond)
+	}
+}
+
+func fileExists(name string) bool {
+	_, err := os.Lstat(name)
+	return err == nil
+}
+
+// The work() method runs on its own goroutine until Close() is called, compressing
+// rotated files and pruning old ones.
+func (f *RotatingFile) work() {
+	defer close(f.stopped)
+
+	for {
+		select {
+		case <-f.wake:
+			f.process()
+		case <-f.done:
+			// Finish off any files rotated before we were closed.
+			f.process()
+			return
+		}
+	}
+}
+
+// The process() method compresses the pending rotated files and then prunes the old
+// ones.
+func (f *RotatingFile) process() {
+	f.mu.Lock()
+	backups := f.pending
+	f.pending = nil
+	f.mu.Unlock()
+
+	if len(backups) == 0 {
+		return
+	}
+
+	if f.opts.Compress {
+		for _, backup := range backups {
+			if err := compressFile(backup); err != nil {
+				fmt.Fprintf(os.Stderr, "jsonlog: compressing %s: %s\n", backup, err)
+			}
+		}
+	}
+
+	if f.opts.MaxBackups > 0 {
+		if err := f.prune(); err != nil {
+			fmt.Fprintf(os.Stderr, "jsonlog: removing old log files: %s\n", err)
+		}
+	}
+}
+
+// The prune() method deletes the oldest rotated files beyond MaxBackups. The timestamps
+// in the names sort chronologically, so the names alone tell us which are oldest.
+func (f *RotatingFile) prune() error {
+	ext := filepath.Ext(f.path)
+	base := strings.TrimSuffix(f.path, ext)
+
+	pattern := base + "-????????T??????.???" + ext
+
+	var backups []string
+	for _, pattern := range []string{pattern, pattern + ".gz"} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return err
+		}
+		backups = append(backups, matches...)
+	}
+
+	if len(backups) <= f.opts.MaxBackups {
+		return nil
+	}
+
+	sort.Strings(backups)
+
+	for _, name := range backups[:len(backups)-f.opts.MaxBackups] {
+		err := os.Remove(name)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close closes the current file and waits for any rotated files to be compressed.
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	var err error
+	if f.file != nil {
+		err = f.file.Close()
+		f.file = nil
+	}
+	f.mu.Unlock()
+
+	f.closeOnce.Do(func() { close(f.done) })
+	<-f.stopped
+
+	return err
+}
+
+// The compressFile() helper gzips a file to name.gz and removes the original.
+func compressFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(dst)
+
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+
+	return os.Remove(name)
+}
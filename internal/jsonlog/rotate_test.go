@@ -0,0 +1,239 @@
+package jsonlog
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The backups() helper returns the names of the rotated files next to path, oldest
+// first.
+func backups(t *testing.T, path string) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.Name() != filepath.Base(path) {
+			names = append(names, entry.Name())
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func readFile(t *testing.T, name string) string {
+	t.Helper()
+
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func write(t *testing.T, f *RotatingFile, s string) {
+	t.Helper()
+
+	_, err := f.Write([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRotatingFileMaxSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.log")
+
+	f, err := OpenFile(path, RotateOptions{MaxSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write(t, f, "12345\n")
+	write(t, f, "6789\n")
+	write(t, f, "abc\n")
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	names := backups(t, path)
+	if len(names) != 1 {
+		t.Fatalf("got backups %v, want 1", names)
+	}
+	// The second write would take the file over 10 bytes, so it starts the new file.
+	if got := readFile(t, filepath.Join(filepath.Dir(path), names[0])); got != "12345\n" {
+		t.Errorf("backup contains %q", got)
+	}
+	if got := readFile(t, path); got != "6789\nabc\n" {
+		t.Errorf("current file contains %q", got)
+	}
+}
+
+func TestRotatingFileMaxSizeAllowsLargeWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.log")
+
+	f, err := OpenFile(path, RotateOptions{MaxSize: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A single entry bigger than the limit goes into an empty file rather than being
+	// rotated into a file of its own over and over.
+	write(t, f, "0123456789\n")
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if names := backups(t, path); len(names) != 0 {
+		t.Errorf("got backups %v, want none", names)
+	}
+}
+
+func TestRotatingFileMaxAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.log")
+
+	f, err := OpenFile(path, RotateOptions{MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write(t, f, "old\n")
+
+	f.mu.Lock()
+	f.opened = time.Now().Add(-2 * time.Hour)
+	f.mu.Unlock()
+
+	write(t, f, "new\n")
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	names := backups(t, path)
+	if len(names) != 1 {
+		t.Fatalf("got backups %v, want 1", names)
+	}
+	if got := readFile(t, path); got != "new\n" {
+		t.Errorf("current file contains %q", got)
+	}
+}
+
+func TestRotatingFileSameMillisecond(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.log")
+
+	f, err := OpenFile(path, RotateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		write(t, f, strings.Repeat("x", i+1)+"\n")
+		if err := f.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every rotation must get its own file, in order, however quickly they happen.
+	names := backups(t, path)
+	if len(names) != 5 {
+		t.Fatalf("got backups %v, want 5", names)
+	}
+	for i, name := range names {
+		want := strings.Repeat("x", i+1) + "\n"
+		if got := readFile(t, filepath.Join(filepath.Dir(path), name)); got != want {
+			t.Errorf("backup %s contains %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestRotatingFilePruneAndCompress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.log")
+
+	f, err := OpenFile(path, RotateOptions{MaxBackups: 2, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		write(t, f, strings.Repeat("x", i+1)+"\n")
+		if err := f.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the two newest backups are kept, and both are compressed.
+	names := backups(t, path)
+	if len(names) != 2 {
+		t.Fatalf("got backups %v, want 2", names)
+	}
+
+	for i, name := range names {
+		if !strings.HasSuffix(name, ".log.gz") {
+			t.Errorf("backup %s isn't compressed", name)
+			continue
+		}
+
+		file, err := os.Open(filepath.Join(filepath.Dir(path), name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := io.ReadAll(zr)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := strings.Repeat("x", i+4) + "\n"; string(b) != want {
+			t.Errorf("backup %s contains %q, want %q", name, b, want)
+		}
+	}
+}
+
+func TestRotatingFileClosed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.log")
+
+	f, err := OpenFile(path, RotateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf("second Close returned %v", err)
+	}
+
+	if _, err := f.Write([]byte("x\n")); err != os.ErrClosed {
+		t.Errorf("Write after Close returned %v, want os.ErrClosed", err)
+	}
+	if err := f.Rotate(); err != os.ErrClosed {
+		t.Errorf("Rotate after Close returned %v, want os.ErrClosed", err)
+	}
+}
@@ -0,0 +1,59 @@
+//go:build !windows && !plan9
+
+package jsonlog
+
+import (
+	"log/syslog"
+)
+
+// Syslog is an output which sends log entries to the local syslog daemon, using the
+// syslog severity which matches the level of each entry.
+type Syslog struct {
+	w *syslog.Writer
+}
+
+// NewSyslog connects to the local syslog daemon. Entries are sent with the daemon
+// facility and tagged with tag.
+func NewSyslog(tag string) (*Syslog, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Syslog{w: w}, nil
+}
+
+// Write sends an entry at the informational severity. The Logger uses WriteLevel()
+// instead, so this is only used by other code writing to the output directly.
+func (s *Syslog) Write(p []byte) (int, error) {
+	return s.WriteLevel(LevelInfo, p)
+}
+
+// WriteLevel sends an entry with the syslog severity for level.
+func (s *Syslog) WriteLevel(level Level, p []byte) (int, error) {
+	var err error
+
+	msg := string(p)
+
+	switch level {
+	case LevelDebug:
+		err = s.w.Debug(msg)
+	case LevelInfo:
+		err = s.w.Info(msg)
+	case LevelWarn:
+		err = s.w.Warning(msg)
+	case LevelError:
+		err = s.w.Err(msg)
+	default:
+		err = s.w.Crit(msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (s *Syslog) Close() error {
+	return s.w.Close()
+}
@@ -0,0 +1,25 @@
+//go:build windows || plan9
+
+package jsonlog
+
+import "errors"
+
+// Syslog isn't available on this platform.
+type Syslog struct{}
+
+// NewSyslog always fails, as there is no local syslog daemon on this platform.
+func NewSyslog(tag string) (*Syslog, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
+
+func (s *Syslog) Write(p []byte) (int, error) {
+	return 0, errors.New("syslog is not supported on this platform")
+}
+
+func (s *Syslog) WriteLevel(level Level, p []byte) (int, error) {
+	return s.Write(p)
+}
+
+func (s *Syslog) Close() error {
+	return nil
+}
@@ -0,0 +1,176 @@
+package jwtauth
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ErrInvalidToken is returned by Verify() for any token which is malformed, has a bad
+// signature, has expired or was issued for a different issuer or audience.
+var ErrInvalidToken = errors.New("invalid token")
+
+// Key is a single named signing key. For HS256 the Secret is the HMAC secret itself,
+// and for EdDSA it is the 32-byte Ed25519 seed.
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// ParseKeys parses a space separated list of "kid:secret" pairs, as passed on the
+// command line. For HS256 the secret is used as-is, and for EdDSA it must be the
+// base64-encoded Ed25519 seed. The first key in the list is the one used for signing;
+// the remaining keys are only used to verify tokens signed before a rotation.
+func ParseKeys(alg, val string) ([]Key, error) {
+	var keys []Key
+
+	for _, field := range strings.Fields(val) {
+		kid, secret, ok := strings.Cut(field, ":")
+		if !ok || kid == "" || secret == "" {
+			return nil, fmt.Errorf("jwt key %q must be in the format kid:secret", field)
+		}
+
+		key := Key{ID: kid, Secret: []byte(secret)}
+
+		if alg == "EdDSA" {
+			seed, err := base64.StdEncoding.DecodeString(secret)
+			if err != nil {
+				return nil, fmt.Errorf("jwt key %q: %w", kid, err)
+			}
+			key.Secret = seed
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// Authority issues and verifies signed JWTs for authenticated users.
+type Authority struct {
+	method     jwt.SigningMethod
+	signingKID string
+	signingKey interface{}
+	verifyKeys map[string]interface{}
+	issuer     string
+	audience   string
+}
+
+// New returns an Authority using the given algorithm ("HS256" or "EdDSA"). Tokens are
+// signed with the first key and carry its ID in the "kid" header, and any of the keys
+// can be used to verify a token.
+func New(alg string, keys []Key, issuer, audience string) (*Authority, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("at least one jwt key must be provided")
+	}
+
+	a := &Authority{
+		signingKID: keys[0].ID,
+		verifyKeys: make(map[string]interface{}),
+		issuer:     issuer,
+		audience:   audience,
+	}
+
+	for i, key := range keys {
+		if _, exists := a.verifyKeys[key.ID]; exists {
+			return nil, fmt.Errorf("duplicate jwt key id %q", key.ID)
+		}
+
+		var signKey, verifyKey interface{}
+
+		switch alg {
+		case "HS256":
+			if len(key.Secret) < 32 {
+				return nil, fmt.Errorf("jwt key %q must be at least 32 bytes long", key.ID)
+			}
+			a.method = jwt.SigningMethodHS256
+			signKey, verifyKey = key.Secret, key.Secret
+		case "EdDSA":
+			if len(key.Secret) != ed25519.SeedSize {
+				return nil, fmt.Errorf("jwt key %q must be a %d byte Ed25519 seed", key.ID, ed25519.SeedSize)
+			}
+			a.method = jwt.SigningMethodEdDSA
+			privateKey := ed25519.NewKeyFromSeed(key.Secret)
+			signKey, verifyKey = privateKey, privateKey.Public()
+		default:
+			return nil, fmt.Errorf("unsupported jwt algorithm %q", alg)
+		}
+
+		if i == 0 {
+			a.signingKey = signKey
+		}
+		a.verifyKeys[key.ID] = verifyKey
+	}
+
+	return a, nil
+}
+
+// Issue returns a signed token for the user which expires after ttl, along with its
+// expiry time.
+func (a *Authority) Issue(userID int64, ttl time.Duration) (string, time.Time, error) {
+	now := time.Now()
+	expiry := now.Add(ttl)
+
+	claims := jwt.RegisteredClaims{
+		Subject:   strconv.FormatInt(userID, 10),
+		Issuer:    a.issuer,
+		Audience:  jwt.ClaimStrings{a.audience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(expiry),
+	}
+
+	token := jwt.NewWithClaims(a.method, claims)
+	token.Header["kid"] = a.signingKID
+
+	signed, err := token.SignedString(a.signingKey)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return signed, expiry, nil
+}
+
+// Verify checks the token's signature, expiry, issuer and audience, and returns the ID
+// of the user it was issued for. The token only carries the user ID, so callers which
+// need to know whether the user is activated, or what they're permitted to do, still
+// have to look that up.
+func (a *Authority) Verify(tokenString string) (int64, error) {
+	var claims jwt.RegisteredClaims
+
+	_, err := jwt.ParseWithClaims(tokenString, &claims, a.keyFor,
+		jwt.WithValidMethods([]string{a.method.Alg()}),
+		jwt.WithIssuer(a.issuer),
+		jwt.WithAudience(a.audience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || userID < 1 {
+		return 0, fmt.Errorf("%w: bad subject", ErrInvalidToken)
+	}
+
+	return userID, nil
+}
+
+// The keyFor() method looks up the verification key named by the token's "kid"
+// header.
+func (a *Authority) keyFor(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	key, ok := a.verifyKeys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+
+	return key, nil
+}
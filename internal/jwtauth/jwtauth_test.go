@@ -0,0 +1,319 @@
+package jwtauth
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testIssuer   = "sendchamp"
+	testAudience = "sendchamp-api"
+)
+
+var (
+	hsKey  = Key{ID: "hs1", Secret: []byte(strings.Repeat("s", 32))}
+	edKey  = Key{ID: "ed1", Secret: []byte(strings.Repeat("e", ed25519.SeedSize))}
+	edKey2 = Key{ID: "ed2", Secret: []byte(strings.Repeat("f", ed25519.SeedSize))}
+)
+
+func newAuthority(t *testing.T, alg string, keys ...Key) *Authority {
+	t.Helper()
+
+	a, err := New(alg, keys, testIssuer, testAudience)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a
+}
+
+// validClaims returns the claims Issue() would use for user 1, so that each test case
+// only has to change the one it is about.
+func validClaims() jwt.MapClaims {
+	now := time.Now()
+
+	return jwt.MapClaims{
+		"sub": "1",
+		"iss": testIssuer,
+		"aud": []string{testAudience},
+		"iat": now.Unix(),
+		"nbf": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+}
+
+// The sign() helper signs claims with the given method and key, setting the "kid"
+// header unless kid is empty.
+func sign(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed
+}
+
+func TestIssueAndVerify(t *testing.T) {
+	for _, tt := range []struct {
+		alg string
+		key Key
+	}{
+		{"HS256", hsKey},
+		{"EdDSA", edKey},
+	} {
+		t.Run(tt.alg, func(t *testing.T) {
+			a := newAuthority(t, tt.alg, tt.key)
+
+			token, expiry, err := a.Issue(42, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if time.Until(expiry) < 59*time.Minute {
+				t.Errorf("got expiry %v, want an hour from now", expiry)
+			}
+
+			userID, err := a.Verify(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if userID != 42 {
+				t.Errorf("got user ID %d, want 42", userID)
+			}
+		})
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	edPrivate := ed25519.NewKeyFromSeed(edKey.Secret)
+	edPublic := edPrivate.Public().(ed25519.PublicKey)
+
+	withClaim := func(name string, value interface{}) jwt.MapClaims {
+		claims := validClaims()
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name  string
+		alg   string
+		key   Key
+		token func(t *testing.T) string
+	}{
+		{
+			name: "HS256 token signed with the EdDSA public key",
+			alg:  "EdDSA",
+			key:  edKey,
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodHS256, []byte(edPublic), edKey.ID, validClaims())
+			},
+		},
+		{
+			name: "HS256 token presented to an EdDSA authority",
+			alg:  "EdDSA",
+			key:  edKey,
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodHS256, hsKey.Secret, edKey.ID, validClaims())
+			},
+		},
+		{
+			name: "EdDSA token presented to an HS256 authority",
+			alg:  "HS256",
+			key:  hsKey,
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodEdDSA, edPrivate, hsKey.ID, validClaims())
+			},
+		},
+		{
+			name: "alg none",
+			alg:  "HS256",
+			key:  hsKey,
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, hsKey.ID, validClaims())
+			},
+		},
+		{
+			name: "unknown kid",
+			alg:  "HS256",
+			key:  hsKey,
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodHS256, hsKey.Secret, "other", validClaims())
+			},
+		},
+		{
+			name: "missing kid",
+			alg:  "HS256",
+			key:  hsKey,
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodHS256, hsKey.Secret, "", validClaims())
+			},
+		},
+		{
+			name: "wrong signature",
+			alg:  "HS256",
+			key:  hsKey,
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodHS256, []byte(strings.Repeat("x", 32)), hsKey.ID, validClaims())
+			},
+		},
+		{
+			name: "expired",
+			alg:  "HS256",
+			key:  hsKey,
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodHS256, hsKey.Secret, hsKey.ID, withClaim("exp", time.Now().Add(-time.Minute).Unix()))
+			},
+		},
+		{
+			name: "missing exp",
+			alg:  "HS256",
+			key:  hsKey,
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodHS256, hsKey.Secret, hsKey.ID, withClaim("exp", nil))
+			},
+		},
+		{
+			name: "wrong issuer",
+			alg:  "HS256",
+			key:  hsKey,
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodHS256, hsKey.Secret, hsKey.ID, withClaim("iss", "someone-else"))
+			},
+		},
+		{
+			name: "wrong audience",
+			alg:  "HS256",
+			key:  hsKey,
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodHS256, hsKey.Secret, hsKey.ID, withClaim("aud", []string{"another-api"}))
+			},
+		},
+		{
+			name: "non-numeric sub",
+			alg:  "HS256",
+			key:  hsKey,
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodHS256, hsKey.Secret, hsKey.ID, withClaim("sub", "alice"))
+			},
+		},
+		{
+			name: "zero sub",
+			alg:  "HS256",
+			key:  hsKey,
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodHS256, hsKey.Secret, hsKey.ID, withClaim("sub", "0"))
+			},
+		},
+		{
+			name: "malformed",
+			alg:  "HS256",
+			key:  hsKey,
+			token: func(t *testing.T) string {
+				return "not.a.jwt"
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAuthority(t, tt.alg, tt.key)
+
+			userID, err := a.Verify(tt.token(t))
+			if !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("got user ID %d and error %v, want ErrInvalidToken", userID, err)
+			}
+		})
+	}
+}
+
+func TestVerifyRotatedKey(t *testing.T) {
+	before := newAuthority(t, "EdDSA", edKey)
+
+	token, _, err := before.Issue(7, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// After a rotation the new key signs, and the old one is kept for verifying.
+	after := newAuthority(t, "EdDSA", edKey2, edKey)
+
+	userID, err := after.Verify(token)
+	if err != nil || userID != 7 {
+		t.Errorf("verifying a token signed with the rotated-out key: got user ID %d, error %v", userID, err)
+	}
+
+	newToken, _, err := after.Issue(7, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, _, err := jwt.NewParser().ParseUnverified(newToken, jwt.MapClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Header["kid"] != edKey2.ID {
+		t.Errorf("got kid %v, want the new key %q", parsed.Header["kid"], edKey2.ID)
+	}
+
+	// Once the old key is dropped from the list, its tokens are rejected.
+	dropped := newAuthority(t, "EdDSA", edKey2)
+
+	_, err = dropped.Verify(token)
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("verifying a token signed with a dropped key: got error %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name string
+		alg  string
+		keys []Key
+	}{
+		{"no keys", "HS256", nil},
+		{"short HS256 secret", "HS256", []Key{{ID: "k", Secret: []byte("short")}}},
+		{"bad Ed25519 seed", "EdDSA", []Key{{ID: "k", Secret: []byte("short")}}},
+		{"duplicate kid", "HS256", []Key{hsKey, hsKey}},
+		{"unsupported algorithm", "RS256", []Key{hsKey}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.alg, tt.keys, testIssuer, testAudience)
+			if err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	keys, err := ParseKeys("EdDSA", "new:ZmZmZmZmZmZmZmZmZmZmZmZmZmZmZmZmZmZmZmZmZmY= old:ZWVlZWVlZWVlZWVlZWVlZWVlZWVlZWVlZWVlZWVlZWU=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].ID != "new" || string(keys[0].Secret) != string(edKey2.Secret) || keys[1].ID != "old" {
+		t.Errorf("got keys %+v", keys)
+	}
+
+	for _, val := range []string{"nokid", ":secret", "kid:", "kid:not-base64!"} {
+		if _, err := ParseKeys("EdDSA", val); err == nil {
+			t.Errorf("ParseKeys(%q): got no error", val)
+		}
+	}
+}
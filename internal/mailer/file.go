@@ -0,0 +1,42 @@
+package mailer
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// FileMailer writes rendered emails to an io.Writer instead of delivering them. It's
+// intended for local development, where it is typically pointed at os.Stdout or a
+// file.
+type FileMailer struct {
+	out    io.Writer
+	sender string
+	mu     *sync.Mutex
+}
+
+// NewFile returns a FileMailer which writes to out.
+func NewFile(out io.Writer, sender string) FileMailer {
+	return FileMailer{
+		out:    out,
+		sender: sender,
+		mu:     &sync.Mutex{},
+	}
+}
+
+// Send renders the template file and writes the email to the underlying writer. A
+// mutex guards the writes so that concurrent emails don't interleave.
+func (m FileMailer) Send(recipient, templateFile string, data interface{}) error {
+	msg, err := render(templateFile, data)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err = fmt.Fprintf(m.out, "From: %s\nTo: %s\nDate: %s\nSubject: %s\n\n%s\n\n",
+		m.sender, recipient, time.Now().Format(time.RFC1123Z), msg.subject, msg.plainBody)
+	return err
+}
@@ -0,0 +1,73 @@
+package mailer
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	texttemplate "text/template"
+)
+
+// Below we declare a new variable with the type embed.FS (embedded file system) to hold
+// our email templates. This has a comment directive in the format `//go:embed <path>`
+// IMMEDIATELY ABOVE it, which indicates to Go that we want to store the contents of the
+// ./templates directory in the templateFS embedded file system variable.
+
+//go:embed "templates"
+var templateFS embed.FS
+
+// Mailer is implemented by anything that can deliver a templated email. The
+// templateFile is the name of a file in the embedded templates directory, and data is
+// the dynamic data passed to the template when it is rendered.
+type Mailer interface {
+	Send(recipient, templateFile string, data interface{}) error
+}
+
+// message holds the rendered parts of a templated email.
+type message struct {
+	subject   string
+	plainBody string
+	htmlBody  string
+}
+
+// The render() function executes the "subject", "plainBody" and "htmlBody" named
+// templates from the given template file. Every template file is expected to define
+// all three.
+func render(templateFile string, data interface{}) (*message, error) {
+	// The subject and plain-text body are parsed with text/template, so that they
+	// aren't HTML-escaped.
+	tmpl, err := texttemplate.New("email").ParseFS(templateFS, "templates/"+templateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	subject := new(bytes.Buffer)
+	err = tmpl.ExecuteTemplate(subject, "subject", data)
+	if err != nil {
+		return nil, err
+	}
+
+	plainBody := new(bytes.Buffer)
+	err = tmpl.ExecuteTemplate(plainBody, "plainBody", data)
+	if err != nil {
+		return nil, err
+	}
+
+	// The HTML body is parsed again with html/template, which escapes the dynamic data
+	// for us.
+	htmlTmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	htmlBody := new(bytes.Buffer)
+	err = htmlTmpl.ExecuteTemplate(htmlBody, "htmlBody", data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &message{
+		subject:   subject.String(),
+		plainBody: plainBody.String(),
+		htmlBody:  htmlBody.String(),
+	}, nil
+}
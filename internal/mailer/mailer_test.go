@@ -0,0 +1,264 @@
+package mailer
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		templateFile string
+		data         map[string]interface{}
+		wantSubject  string
+		wantInBodies []string
+	}{
+		{
+			templateFile: "user_welcome.tmpl",
+			data:         map[string]interface{}{"name": "Alice", "userID": 42, "activationToken": "ACTIVATIONTOKEN"},
+			wantSubject:  "Welcome to Sendchamp!",
+			wantInBodies: []string{"Alice", "42", "ACTIVATIONTOKEN"},
+		},
+		{
+			templateFile: "token_activation.tmpl",
+			data:         map[string]interface{}{"activationToken": "ACTIVATIONTOKEN"},
+			wantSubject:  "Activate your Sendchamp account",
+			wantInBodies: []string{"ACTIVATIONTOKEN"},
+		},
+		{
+			templateFile: "token_password_reset.tmpl",
+			data:         map[string]interface{}{"passwordResetToken": "RESETTOKEN"},
+			wantSubject:  "Reset your Sendchamp password",
+			wantInBodies: []string{"RESETTOKEN"},
+		},
+	}
+
+	tested := map[string]bool{}
+
+	for _, tt := range tests {
+		tested[tt.templateFile] = true
+
+		t.Run(tt.templateFile, func(t *testing.T) {
+			msg, err := render(tt.templateFile, tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if msg.subject != tt.wantSubject {
+				t.Errorf("got subject %q, want %q", msg.subject, tt.wantSubject)
+			}
+
+			for _, want := range tt.wantInBodies {
+				if !strings.Contains(msg.plainBody, want) {
+					t.Errorf("plain body doesn't contain %q:\n%s", want, msg.plainBody)
+				}
+				if !strings.Contains(msg.htmlBody, want) {
+					t.Errorf("HTML body doesn't contain %q:\n%s", want, msg.htmlBody)
+				}
+			}
+
+			if strings.Contains(msg.plainBody, "<p>") || !strings.Contains(msg.htmlBody, "<p>") {
+				t.Error("plain and HTML bodies are mixed up")
+			}
+		})
+	}
+
+	// Every embedded template must be covered above.
+	entries, err := fs.ReadDir(templateFS, "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if !tested[entry.Name()] {
+			t.Errorf("template %s has no render test", entry.Name())
+		}
+	}
+}
+
+func TestRenderEscapesHTML(t *testing.T) {
+	msg, err := render("user_welcome.tmpl", map[string]interface{}{"name": "<b>Alice</b>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(msg.plainBody, "Hi <b>Alice</b>,") {
+		t.Errorf("plain body was escaped:\n%s", msg.plainBody)
+	}
+	if !strings.Contains(msg.htmlBody, "Hi &lt;b&gt;Alice&lt;/b&gt;,") {
+		t.Errorf("HTML body wasn't escaped:\n%s", msg.htmlBody)
+	}
+}
+
+func TestRenderUnknownTemplate(t *testing.T) {
+	_, err := render("nothing.tmpl", nil)
+	if err == nil {
+		t.Error("got no error for an unknown template")
+	}
+}
+
+// smtpSession records what a client sent to the fake SMTP server.
+type smtpSession struct {
+	from       string
+	recipients []string
+	data       []byte
+}
+
+// The fakeSMTPServer() helper listens on a random local port and serves a single SMTP
+// session, without STARTTLS or AUTH. The session is sent on the returned channel once
+// the client quits or the connection fails.
+func fakeSMTPServer(t *testing.T) (net.Listener, <-chan smtpSession) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	sessions := make(chan smtpSession, 1)
+
+	go func() {
+		var s smtpSession
+		defer func() { sessions <- s }()
+
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		tp := textproto.NewConn(conn)
+		tp.PrintfLine("220 localhost ESMTP")
+
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+
+			verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			switch verb {
+			case "EHLO", "HELO":
+				tp.PrintfLine("250 localhost")
+			case "MAIL":
+				s.from = strings.TrimPrefix(line, "MAIL FROM:")
+				tp.PrintfLine("250 OK")
+			case "RCPT":
+				s.recipients = append(s.recipients, strings.TrimPrefix(line, "RCPT TO:"))
+				tp.PrintfLine("250 OK")
+			case "DATA":
+				tp.PrintfLine("354 go ahead")
+				s.data, err = tp.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				tp.PrintfLine("250 OK")
+			case "QUIT":
+				tp.PrintfLine("221 bye")
+				return
+			default:
+				tp.PrintfLine("502 not implemented")
+			}
+		}
+	}()
+
+	return ln, sessions
+}
+
+func TestSMTPMailerSend(t *testing.T) {
+	ln, sessions := fakeSMTPServer(t)
+
+	m := NewSMTP("127.0.0.1", ln.Addr().(*net.TCPAddr).Port, "", "", "Sendchamp <no-reply@sendchamp.com>")
+
+	err := m.Send("alice@example.com", "user_welcome.tmpl", map[string]interface{}{
+		"name":            "Alice",
+		"userID":          42,
+		"activationToken": "ACTIVATIONTOKEN",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := <-sessions
+
+	if s.from != "<no-reply@sendchamp.com>" {
+		t.Errorf("got MAIL FROM %q, want the bare sender address", s.from)
+	}
+	if len(s.recipients) != 1 || s.recipients[0] != "<alice@example.com>" {
+		t.Errorf("got recipients %q", s.recipients)
+	}
+
+	msg, err := mail.ReadMessage(bufio.NewReader(bytes.NewReader(s.data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if to := msg.Header.Get("To"); to != "alice@example.com" {
+		t.Errorf("got To header %q", to)
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != "Welcome to Sendchamp!" {
+		t.Errorf("got Subject header %q (%v)", msg.Header.Get("Subject"), err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("got Content-Type %q (%v)", msg.Header.Get("Content-Type"), err)
+	}
+
+	// The multipart reader decodes the quoted-printable bodies for us.
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+
+	wantParts := []struct {
+		contentType string
+		contains    string
+	}{
+		{"text/plain", "Hi Alice,"},
+		{"text/html", "<p>Hi Alice,</p>"},
+	}
+
+	for _, want := range wantParts {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("reading %s part: %v", want.contentType, err)
+		}
+
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if partType != want.contentType {
+			t.Errorf("got part %q, want %q", partType, want.contentType)
+		}
+
+		body, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(body), want.contains) || !strings.Contains(string(body), "ACTIVATIONTOKEN") {
+			t.Errorf("%s part doesn't contain the expected content:\n%s", want.contentType, body)
+		}
+	}
+
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("got an unexpected extra part (%v)", err)
+	}
+}
+
+func TestSMTPMailerSendUnknownTemplate(t *testing.T) {
+	m := NewSMTP("127.0.0.1", 1, "", "", "no-reply@sendchamp.com")
+
+	// The template is rendered before connecting, so nothing is listening on the port.
+	err := m.Send("alice@example.com", "nothing.tmpl", nil)
+	var opErr *net.OpError
+	if err == nil || errors.As(err, &opErr) {
+		t.Errorf("got error %v, want a template error", err)
+	}
+}
@@ -0,0 +1,466 @@
+// Package migrate applies the SQL migrations embedded in the migrations package. The
+// applied version is tracked in a schema_migrations table with the same layout the
+// golang-migrate tool uses, so databases which were migrated with the external tool
+// can be managed by this package without any conversion.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrDirty is returned when a previous migration failed part way through. The
+	// schema has to be repaired by hand and the version set with Force().
+	ErrDirty = errors.New("database is dirty, fix the failed migration and force the version")
+
+	// ErrUnknownVersion is returned when the database is at a version that doesn't
+	// have a migration file, for example after running a newer binary.
+	ErrUnknownVersion = errors.New("database version has no migration file")
+)
+
+// The dialect struct holds the differences between the databases we support.
+type dialect struct {
+	// dir is the directory within the migrations filesystem holding the files.
+	dir string
+	// placeholder returns the bind parameter for the n'th argument (counting from 1).
+	placeholder func(n int) string
+	// split reports whether each file has to be split into single statements before
+	// being executed, because the driver doesn't run several statements at once.
+	split bool
+	// lock and unlock take a session-level advisory lock, so that several instances
+	// started with -db-auto-migrate don't race each other. The lock query returns 1
+	// once the lock is held. They're empty if the database doesn't need one.
+	lock, unlock string
+}
+
+// lockName identifies our advisory lock. PostgreSQL needs a number, so we use a fixed
+// one there.
+const (
+	lockName = "sendchamp_schema_migrations"
+	lockKey  = 2064813951
+)
+
+var dialects = map[string]dialect{
+	"mysql": {
+		dir:         ".",
+		placeholder: func(int) string { return "?" },
+		split:       true,
+		lock:        "SELECT GET_LOCK('" + lockName + "', 60)",
+		unlock:      "SELECT RELEASE_LOCK('" + lockName + "')",
+	},
+	"postgres": {
+		dir:         "postgres",
+		placeholder: func(n int) string { return "$" + strconv.Itoa(n) },
+		lock:        "SELECT 1 FROM (SELECT pg_advisory_lock(" + strconv.Itoa(lockKey) + ")) AS l",
+		unlock:      "SELECT pg_advisory_unlock(" + strconv.Itoa(lockKey) + ")",
+	},
+	"sqlite": {
+		dir:         "sqlite",
+		placeholder: func(int) string { return "?" },
+	},
+}
+
+// Migration is a single numbered migration, read from a pair of NNNNNN_name.up.sql
+// and NNNNNN_name.down.sql files.
+type Migration struct {
+	Version int64
+	Name    string
+	up      string
+	down    string
+}
+
+// Status describes a migration and whether it has been applied.
+type Status struct {
+	Migration
+	Applied bool
+}
+
+// Migrator applies migrations to a database.
+type Migrator struct {
+	db         *sql.DB
+	dialect    dialect
+	migrations []Migration
+}
+
+var filenameRX = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// New returns a Migrator for the given database driver, reading the migration files
+// for that driver from fsys.
+func New(db *sql.DB, driver string, fsys fs.FS) (*Migrator, error) {
+	d, ok := dialects[driver]
+	if !ok {
+		return nil, fmt.Errorf("migrate: no migrations for driver %q", driver)
+	}
+
+	entries, err := fs.ReadDir(fsys, d.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+
+	for _, entry := range entries {
+		matches := filenameRX.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || matches == nil {
+			continue
+		}
+
+		version, err := strconv.ParseInt(matches[1], 10, 64)
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("migrate: invalid version in %s", entry.Name())
+		}
+
+		content, err := fs.ReadFile(fsys, path.Join(d.dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: matches[2]}
+			byVersion[version] = migration
+		}
+
+		if migration.Name != matches[2] {
+			return nil, fmt.Errorf("migrate: version %d used by %s and %s", version, migration.Name, matches[2])
+		}
+
+		if matches[3] == "up" {
+			migration.up = string(content)
+		} else {
+			migration.down = string(content)
+		}
+	}
+
+	m := &Migrator{db: db, dialect: d}
+
+	for _, migration := range byVersion {
+		m.migrations = append(m.migrations, *migration)
+	}
+
+	sort.Slice(m.migrations, func(i, j int) bool {
+		return m.migrations[i].Version < m.migrations[j].Version
+	})
+
+	return m, nil
+}
+
+// Up applies every migration newer than the current version, and returns the
+// migrations which were applied.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	var applied []Migration
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		version, err := m.current(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.migrations {
+			if migration.Version <= version {
+				continue
+			}
+
+			err = m.run(ctx, conn, migration.up, migration.Version, migration.Version)
+			if err != nil {
+				return fmt.Errorf("migrate: applying %d_%s: %w", migration.Version, migration.Name, err)
+			}
+
+			applied = append(applied, migration)
+		}
+
+		return nil
+	})
+
+	return applied, err
+}
+
+// Down rolls back the given number of migrations, most recent first, and returns the
+// migrations which were rolled back.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var reverted []Migration
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		version, err := m.current(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(m.migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+			migration := m.migrations[i]
+			if migration.Version > version {
+				continue
+			}
+
+			// The version after rolling back is the one before this migration, or
+			// zero when there's nothing left.
+			var previous int64
+			if i > 0 {
+				previous = m.migrations[i-1].Version
+			}
+
+			err = m.run(ctx, conn, migration.down, migration.Version, previous)
+			if err != nil {
+				return fmt.Errorf("migrate: rolling back %d_%s: %w", migration.Version, migration.Name, err)
+			}
+
+			reverted = append(reverted, migration)
+		}
+
+		return nil
+	})
+
+	return reverted, err
+}
+
+// Status returns the current version, whether it is dirty, and every known migration
+// along with whether it has been applied.
+func (m *Migrator) Status(ctx context.Context) (int64, bool, []Status, error) {
+	var (
+		version int64
+		dirty   bool
+	)
+
+	err := m.withConn(ctx, func(conn *sql.Conn) error {
+		if err := m.ensureTable(ctx, conn); err != nil {
+			return err
+		}
+
+		var err error
+		version, dirty, err = m.version(ctx, conn)
+		return err
+	})
+	if err != nil {
+		return 0, false, nil, err
+	}
+
+	statuses := make([]Status, len(m.migrations))
+	for i, migration := range m.migrations {
+		statuses[i] = Status{Migration: migration, Applied: migration.Version <= version}
+	}
+
+	return version, dirty, statuses, nil
+}
+
+// Force sets the recorded version without running any migrations, and clears the
+// dirty flag. It's used to recover after a failed migration has been fixed by hand.
+// A version of 0 records that no migrations have been applied.
+func (m *Migrator) Force(ctx context.Context, version int64) error {
+	if version != 0 && m.find(version) < 0 {
+		return fmt.Errorf("migrate: no migration with version %d", version)
+	}
+
+	return m.withLock(ctx, func(conn *sql.Conn) error {
+		return m.setVersion(ctx, conn, version, false)
+	})
+}
+
+// The current() method returns the current version, failing if the database is dirty
+// or at a version we don't know about.
+func (m *Migrator) current(ctx context.Context, conn *sql.Conn) (int64, error) {
+	version, dirty, err := m.version(ctx, conn)
+	if err != nil {
+		return 0, err
+	}
+
+	if dirty {
+		return 0, fmt.Errorf("migrate: version %d: %w", version, ErrDirty)
+	}
+
+	if version != 0 && m.find(version) < 0 {
+		return 0, fmt.Errorf("migrate: version %d: %w", version, ErrUnknownVersion)
+	}
+
+	return version, nil
+}
+
+// The run() method executes a migration file. The version is marked dirty while the
+// file runs, so that a failure part way through (which can't be rolled back on MySQL,
+// where DDL statements commit implicitly) isn't silently built upon.
+func (m *Migrator) run(ctx context.Context, conn *sql.Conn, content string, version, after int64) error {
+	err := m.setVersion(ctx, conn, version, true)
+	if err != nil {
+		return err
+	}
+
+	statements := []string{content}
+	if m.dialect.split {
+		statements = splitStatements(content)
+	}
+
+	for _, statement := range statements {
+		if strings.TrimSpace(statement) == "" {
+			continue
+		}
+
+		_, err = conn.ExecContext(ctx, statement)
+		if err != nil {
+			return err
+		}
+	}
+
+	return m.setVersion(ctx, conn, after, false)
+}
+
+// The find() method returns the index of the migration with the given version, or -1.
+func (m *Migrator) find(version int64) int {
+	for i, migration := range m.migrations {
+		if migration.Version == version {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// The withConn() method runs fn on a single connection from the pool. Advisory locks
+// belong to a session, so everything has to happen on the same connection.
+func (m *Migrator) withConn(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return fn(conn)
+}
+
+// The withLock() method runs fn on a single connection while holding the advisory
+// lock, after making sure that the schema_migrations table exists.
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	return m.withConn(ctx, func(conn *sql.Conn) error {
+		if m.dialect.lock != "" {
+			lockCtx, cancel := context.WithTimeout(ctx, 90*time.Second)
+			defer cancel()
+
+			var acquired sql.NullInt64
+			err := conn.QueryRowContext(lockCtx, m.dialect.lock).Scan(&acquired)
+			if err != nil {
+				return fmt.Errorf("migrate: acquiring lock: %w", err)
+			}
+			// MySQL's GET_LOCK() returns 0 on timeout rather than an error.
+			if acquired.Int64 != 1 {
+				return errors.New("migrate: timed out waiting for the migration lock")
+			}
+
+			defer conn.ExecContext(context.Background(), m.dialect.unlock)
+		}
+
+		if err := m.ensureTable(ctx, conn); err != nil {
+			return err
+		}
+
+		return fn(conn)
+	})
+}
+
+func (m *Migrator) ensureTable(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version bigint NOT NULL PRIMARY KEY,
+			dirty boolean NOT NULL
+		)`)
+	return err
+}
+
+// The version() method returns the recorded version and dirty flag. Like
+// golang-migrate, we keep at most one row in the table, and no row means version 0.
+func (m *Migrator) version(ctx context.Context, conn *sql.Conn) (int64, bool, error) {
+	var (
+		version int64
+		dirty   bool
+	)
+
+	err := conn.QueryRowContext(ctx, "SELECT version, dirty FROM schema_migrations LIMIT 1").Scan(&version, &dirty)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, false, nil
+		default:
+			return 0, false, err
+		}
+	}
+
+	return version, dirty, nil
+}
+
+func (m *Migrator) setVersion(ctx context.Context, conn *sql.Conn, version int64, dirty bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM schema_migrations")
+	if err != nil {
+		return err
+	}
+
+	if version != 0 || dirty {
+		query := fmt.Sprintf("INSERT INTO schema_migrations (version, dirty) VALUES (%s, %s)",
+			m.dialect.placeholder(1), m.dialect.placeholder(2))
+
+		_, err = tx.ExecContext(ctx, query, version, dirty)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// The splitStatements() helper splits a migration file on the semicolons between
+// statements, ignoring any inside quotes or comments. Pieces which are only whitespace
+// and comments are left out, as MySQL refuses to execute an empty query.
+func splitStatements(content string) []string {
+	var (
+		statements []string
+		start      int
+		quote      byte
+		hasCode    bool
+	)
+
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+			hasCode = true
+		case c == '-' && strings.HasPrefix(content[i:], "--"):
+			if end := strings.IndexByte(content[i:], '\n'); end >= 0 {
+				i += end
+			} else {
+				i = len(content)
+			}
+		case c == ';':
+			if hasCode {
+				statements = append(statements, content[start:i])
+			}
+			start = i + 1
+			hasCode = false
+		case c != ' ' && c != '\t' && c != '\n' && c != '\r':
+			hasCode = true
+		}
+	}
+
+	if hasCode {
+		statements = append(statements, content[start:])
+	}
+
+	return statements
+}
@@ -0,0 +1,395 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/JacobNewton007/sendchamp-go-test/migrations"
+	_ "modernc.org/sqlite"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{
+			name:    "single statement without a semicolon",
+			content: "SELECT 1",
+			want:    []string{"SELECT 1"},
+		},
+		{
+			name:    "several statements",
+			content: "SELECT 1;\nSELECT 2;",
+			want:    []string{"SELECT 1", "\nSELECT 2"},
+		},
+		{
+			name:    "semicolons in single quotes",
+			content: "INSERT INTO t VALUES ('a;b');SELECT 2",
+			want:    []string{"INSERT INTO t VALUES ('a;b')", "SELECT 2"},
+		},
+		{
+			name:    "semicolons in double quotes and backticks",
+			content: "SELECT \"a;b\" AS `c;d`;SELECT 2",
+			want:    []string{"SELECT \"a;b\" AS `c;d`", "SELECT 2"},
+		},
+		{
+			name:    "escaped quote",
+			content: "SELECT 'it''s; fine';SELECT 2",
+			want:    []string{"SELECT 'it''s; fine'", "SELECT 2"},
+		},
+		{
+			name:    "semicolon in a comment",
+			content: "-- first; then\nSELECT 1;",
+			want:    []string{"-- first; then\nSELECT 1"},
+		},
+		{
+			name:    "quote in a comment",
+			content: "-- don't split here\nSELECT 1;SELECT 2",
+			want:    []string{"-- don't split here\nSELECT 1", "SELECT 2"},
+		},
+		{
+			name:    "trailing comment",
+			content: "SELECT 1;\n-- done; really",
+			want:    []string{"SELECT 1"},
+		},
+		{
+			name:    "trailing whitespace",
+			content: "SELECT 1;\n\n  \t\r\n",
+			want:    []string{"SELECT 1"},
+		},
+		{
+			name:    "empty statements",
+			content: ";;SELECT 1;;",
+			want:    []string{"SELECT 1"},
+		},
+		{
+			name:    "empty",
+			content: "",
+			want:    nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitStatements(tt.content)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// The openDB() helper opens an empty SQLite database in a temporary directory.
+func openDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", "file:"+filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+// testFS holds three small SQLite migrations. The third one fails part way through.
+var testFS = fstest.MapFS{
+	"sqlite/000001_a.up.sql":   {Data: []byte("CREATE TABLE a (id integer);")},
+	"sqlite/000001_a.down.sql": {Data: []byte("DROP TABLE a;")},
+	"sqlite/000002_b.up.sql":   {Data: []byte("CREATE TABLE b (id integer);")},
+	"sqlite/000002_b.down.sql": {Data: []byte("DROP TABLE b;")},
+	"sqlite/000003_c.up.sql":   {Data: []byte("CREATE TABLE c (id integer); INSERT INTO missing VALUES (1);")},
+	"sqlite/000003_c.down.sql": {Data: []byte("DROP TABLE c;")},
+}
+
+// The withoutFailing() helper returns testFS without the third migration.
+func withoutFailing() fstest.MapFS {
+	fsys := fstest.MapFS{}
+	for name, file := range testFS {
+		if !strings.HasPrefix(name, "sqlite/000003_") {
+			fsys[name] = file
+		}
+	}
+
+	return fsys
+}
+
+// The tableExists() helper reports whether the SQLite database has the named table.
+func tableExists(t *testing.T, db *sql.DB, name string) bool {
+	t.Helper()
+
+	var count int
+
+	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", name).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return count == 1
+}
+
+// The checkStatus() helper fails the test unless the database is at the given version
+// and dirty flag.
+func checkStatus(t *testing.T, m *Migrator, wantVersion int64, wantDirty bool) []Status {
+	t.Helper()
+
+	version, dirty, statuses, err := m.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version != wantVersion || dirty != wantDirty {
+		t.Fatalf("got version %d, dirty %t, want version %d, dirty %t", version, dirty, wantVersion, wantDirty)
+	}
+
+	return statuses
+}
+
+func TestUpDownStatus(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+
+	m, err := New(db, "sqlite", withoutFailing())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statuses := checkStatus(t, m, 0, false)
+	if len(statuses) != 2 || statuses[0].Applied || statuses[1].Applied {
+		t.Errorf("got statuses %+v before migrating", statuses)
+	}
+
+	applied, err := m.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 2 || applied[0].Name != "a" || applied[1].Name != "b" {
+		t.Errorf("Up applied %+v", applied)
+	}
+	if !tableExists(t, db, "a") || !tableExists(t, db, "b") {
+		t.Error("Up didn't create the tables")
+	}
+
+	statuses = checkStatus(t, m, 2, false)
+	if !statuses[0].Applied || !statuses[1].Applied {
+		t.Errorf("got statuses %+v after Up", statuses)
+	}
+
+	// Running Up again has nothing to do.
+	applied, err = m.Up(ctx)
+	if err != nil || len(applied) != 0 {
+		t.Errorf("second Up applied %+v, error %v", applied, err)
+	}
+
+	reverted, err := m.Down(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reverted) != 1 || reverted[0].Version != 2 {
+		t.Errorf("Down(1) rolled back %+v", reverted)
+	}
+	if !tableExists(t, db, "a") || tableExists(t, db, "b") {
+		t.Error("Down(1) didn't drop just the newest table")
+	}
+
+	statuses = checkStatus(t, m, 1, false)
+	if !statuses[0].Applied || statuses[1].Applied {
+		t.Errorf("got statuses %+v after Down(1)", statuses)
+	}
+
+	// Asking for more steps than there are stops at version 0.
+	reverted, err = m.Down(ctx, 10)
+	if err != nil || len(reverted) != 1 {
+		t.Errorf("Down(10) rolled back %+v, error %v", reverted, err)
+	}
+	if tableExists(t, db, "a") {
+		t.Error("Down(10) didn't drop the table")
+	}
+
+	checkStatus(t, m, 0, false)
+}
+
+func TestDirty(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+
+	m, err := New(db, "sqlite", testFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The third migration fails, leaving the database dirty at its version.
+	applied, err := m.Up(ctx)
+	if err == nil {
+		t.Fatal("Up succeeded, want the third migration to fail")
+	}
+	if len(applied) != 2 {
+		t.Errorf("Up applied %+v before failing", applied)
+	}
+
+	checkStatus(t, m, 3, true)
+
+	// Nothing runs while the database is dirty.
+	_, err = m.Up(ctx)
+	if !errors.Is(err, ErrDirty) {
+		t.Errorf("Up on a dirty database: got error %v, want ErrDirty", err)
+	}
+
+	_, err = m.Down(ctx, 1)
+	if !errors.Is(err, ErrDirty) {
+		t.Errorf("Down on a dirty database: got error %v, want ErrDirty", err)
+	}
+
+	// Repair the schema by hand, and force the version to the last good one.
+	_, err = db.Exec("DROP TABLE IF EXISTS c")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Force(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkStatus(t, m, 2, false)
+
+	// With the migration fixed, Up carries on from there.
+	fixed := fstest.MapFS{}
+	for name, file := range testFS {
+		fixed[name] = file
+	}
+	fixed["sqlite/000003_c.up.sql"] = &fstest.MapFile{Data: []byte("CREATE TABLE c (id integer);")}
+
+	m, err = New(db, "sqlite", fixed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	applied, err = m.Up(ctx)
+	if err != nil || len(applied) != 1 || applied[0].Version != 3 {
+		t.Errorf("Up after Force applied %+v, error %v", applied, err)
+	}
+
+	checkStatus(t, m, 3, false)
+}
+
+func TestForce(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+
+	m, err := New(db, "sqlite", testFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Force(ctx, 7)
+	if err == nil {
+		t.Error("Force to an unknown version succeeded")
+	}
+
+	err = m.Force(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStatus(t, m, 2, false)
+
+	// Forcing doesn't run anything.
+	if tableExists(t, db, "a") {
+		t.Error("Force ran a migration")
+	}
+
+	err = m.Force(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStatus(t, m, 0, false)
+}
+
+func TestUnknownVersion(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+
+	m, err := New(db, "sqlite", testFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Force(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An older binary, which only knows about the first two migrations, refuses to
+	// touch the database.
+	m, err = New(db, "sqlite", withoutFailing())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = m.Up(ctx)
+	if !errors.Is(err, ErrUnknownVersion) {
+		t.Errorf("got error %v, want ErrUnknownVersion", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name string
+		fsys fstest.MapFS
+	}{
+		{"version zero", fstest.MapFS{"sqlite/000000_a.up.sql": {}}},
+		{"version used twice", fstest.MapFS{"sqlite/000001_a.up.sql": {}, "sqlite/000001_b.up.sql": {}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(nil, "sqlite", tt.fsys)
+			if err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+
+	_, err := New(nil, "oracle", testFS)
+	if err == nil {
+		t.Error("unknown driver: got no error")
+	}
+}
+
+// TestEmbeddedSQLite applies and rolls back every embedded SQLite migration, so that a
+// broken down migration is noticed before anyone needs it.
+func TestEmbeddedSQLite(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+
+	m, err := New(db, "sqlite", migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	applied, err := m.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last := applied[len(applied)-1].Version
+	checkStatus(t, m, last, false)
+
+	reverted, err := m.Down(ctx, len(applied))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reverted) != len(applied) {
+		t.Errorf("rolled back %d migrations, want %d", len(reverted), len(applied))
+	}
+
+	checkStatus(t, m, 0, false)
+}
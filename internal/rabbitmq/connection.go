@@ -0,0 +1,387 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/JacobNewton007/sendchamp-go-test/internal/jsonlog"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ErrNotConnected is returned by Connection.Channel() while the connection to the
+// broker is down and being re-established.
+var ErrNotConnected = errors.New("rabbitmq: not connected")
+
+const (
+	// addQueue is the queue tasks are published to and consumed from.
+	addQueue = "add"
+
+	// Tasks which fail with a temporary error are parked in retryQueue, which hands
+	// them back to addQueue after retryDelay. After maxAttempts they're moved to
+	// deadQueue instead, to be looked at by a person.
+	retryQueue  = "add.retry"
+	deadQueue   = "add.dead"
+	retryDelay  = 10 * time.Second
+	maxAttempts = 5
+
+	// The delay before reconnecting doubles after every failed attempt, from
+	// minReconnectDelay up to maxReconnectDelay.
+	minReconnectDelay = 500 * time.Millisecond
+	maxReconnectDelay = 30 * time.Second
+
+	// maxIdleChannels is the number of open channels kept for reuse.
+	maxIdleChannels = 8
+)
+
+// Connection manages a connection to the broker. It watches for the connection being
+// lost and re-establishes it in the background, with exponential backoff, declaring
+// the queues again each time. While it is down, Channel() returns ErrNotConnected
+// rather than blocking, so callers can fail fast.
+//
+// It also keeps a pool of open channels. Opening a channel costs a round trip to the
+// broker, so publishers should take one with Channel() and hand it back with Release()
+// rather than opening one for every message.
+type Connection struct {
+	uri    string
+	logger *jsonlog.Logger
+
+	mu       sync.Mutex
+	conn     *amqp.Connection
+	ready    chan struct{}
+	channels []*Channel
+	closed   bool
+
+	// jitter is only used by the watch() goroutine, so it doesn't need locking.
+	jitter *rand.Rand
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Dial connects to the broker at uri and declares the queues. Only the first attempt
+// to connect is made here, so that a misconfigured URI is reported at startup; after
+// that the connection is re-established whenever it is lost, until Close() is called.
+func Dial(uri string, logger *jsonlog.Logger) (*Connection, error) {
+	c := &Connection{
+		uri:    uri,
+		logger: logger,
+		ready:  make(chan struct{}),
+		jitter: rand.New(rand.NewSource(time.Now().UnixNano())),
+		done:   make(chan struct{}),
+	}
+
+	notify, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	c.wg.Add(1)
+	go c.watch(notify)
+
+	return c, nil
+}
+
+// The connect() method dials the broker, declares the topology and, if that all
+// worked, makes the new connection available. It returns the channel on which the
+// connection reports being closed.
+func (c *Connection) connect() (chan *amqp.Error, error) {
+	conn, err := amqp.Dial(c.uri)
+	if err != nil {
+		return nil, err
+	}
+
+	// Register for the close notification straight away, so that we can't miss the
+	// connection dropping while we're still setting up.
+	notify := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+	err = declareTopology(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		conn.Close()
+		return nil, ErrNotConnected
+	}
+
+	c.conn = conn
+	close(c.ready)
+
+	return notify, nil
+}
+
+// The declareTopology() helper declares the queue and exchange we use. Declaring is
+// idempotent, so it's safe to do on every connect, and it recreates them if the broker
+// lost them along with our connection.
+func declareTopology(conn *amqp.Connection) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("opening channel: %w", err)
+	}
+	defer ch.Close()
+
+	_, err = ch.QueueDeclare(addQueue, true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("declaring %q queue: %w", addQueue, err)
+	}
+
+	// Nothing consumes the retry queue. Messages expire from it after retryDelay and
+	// are dead-lettered back to the add queue through the default exchange.
+	_, err = ch.QueueDeclare(retryQueue, true, false, false, false, amqp.Table{
+		"x-message-ttl":             retryDelay.Milliseconds(),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": addQueue,
+	})
+	if err != nil {
+		return fmt.Errorf("declaring %q queue: %w", retryQueue, err)
+	}
+
+	_, err = ch.QueueDeclare(deadQueue, true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("declaring %q queue: %w", deadQueue, err)
+	}
+
+	err = ch.ExchangeDeclare(eventsExchange, amqp.ExchangeTopic, true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("declaring %q exchange: %w", eventsExchange, err)
+	}
+
+	return nil
+}
+
+// The watch() method waits for the connection to close and reconnects, until Close()
+// is called.
+func (c *Connection) watch(notify chan *amqp.Error) {
+	defer c.wg.Done()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case amqpErr := <-notify:
+			c.mu.Lock()
+			c.conn = nil
+			c.ready = make(chan struct{})
+			c.channels = nil
+			c.mu.Unlock()
+
+			fields := jsonlog.Fields{}
+			if amqpErr != nil {
+				fields["error"] = amqpErr
+			}
+			c.logger.PrintWarn("rabbitmq connection lost, reconnecting", fields)
+		}
+
+		notify = c.reconnect()
+		if notify == nil {
+			return
+		}
+	}
+}
+
+// The reconnect() method keeps trying to connect until it succeeds, returning the new
+// connection's close notification channel, or until Close() is called, in which case
+// it returns nil. The delay between attempts is randomized, so that a fleet of API
+// servers which lost the broker at the same moment don't all hit it at once when it
+// comes back.
+func (c *Connection) reconnect() chan *amqp.Error {
+	delay := minReconnectDelay
+
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-c.done:
+			return nil
+		case <-time.After(c.reconnectWait(delay)):
+		}
+
+		notify, err := c.connect()
+		if err == nil {
+			c.logger.PrintInfo("rabbitmq connection re-established", jsonlog.Fields{
+				"attempts": attempt,
+			})
+			return notify
+		}
+
+		c.logger.PrintWarn("rabbitmq reconnect failed", jsonlog.Fields{
+			"attempt": attempt,
+			"error":   err,
+		})
+
+		delay = nextReconnectDelay(delay)
+	}
+}
+
+// The reconnectWait() method returns how long to wait before the next reconnect
+// attempt: a random duration between half of delay and delay itself.
+func (c *Connection) reconnectWait(delay time.Duration) time.Duration {
+	return delay/2 + time.Duration(c.jitter.Int63n(int64(delay/2)+1))
+}
+
+// The nextReconnectDelay() helper doubles the delay after a failed attempt, up to
+// maxReconnectDelay.
+func nextReconnectDelay(delay time.Duration) time.Duration {
+	delay *= 2
+	if delay > maxReconnectDelay {
+		delay = maxReconnectDelay
+	}
+
+	return delay
+}
+
+// IsConnected reports whether the connection to the broker is currently up.
+func (c *Connection) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.conn != nil && !c.conn.IsClosed()
+}
+
+// WaitReady blocks until the connection is up, or returns ctx.Err() if ctx is done
+// first. It returns ErrNotConnected once the connection has been closed.
+func (c *Connection) WaitReady(ctx context.Context) error {
+	c.mu.Lock()
+	ready := c.ready
+	c.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-c.done:
+		return ErrNotConnected
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Channel is a channel from the pool. It's in confirm mode, so that the broker tells
+// us whether it has taken responsibility for each message we publish, and it reports
+// mandatory messages which couldn't be routed to a queue.
+type Channel struct {
+	amqpChannel
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+}
+
+// amqpChannel is the part of *amqp.Channel which pooled channels use. It's an
+// interface so that the pool and publishing can be tested without a broker.
+type amqpChannel interface {
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	IsClosed() bool
+	Close() error
+}
+
+// Channel returns an open channel from the pool, or opens a new one. Opening a channel
+// is a round trip to the broker, so it's done without holding the mutex.
+func (c *Connection) Channel() (*Channel, error) {
+	c.mu.Lock()
+	conn := c.conn
+
+	var pooled *Channel
+	for conn != nil && len(c.channels) > 0 {
+		ch := c.channels[len(c.channels)-1]
+		c.channels = c.channels[:len(c.channels)-1]
+
+		if !ch.IsClosed() {
+			pooled = ch
+			break
+		}
+	}
+	c.mu.Unlock()
+
+	if conn == nil {
+		return nil, ErrNotConnected
+	}
+
+	if pooled != nil {
+		return pooled, nil
+	}
+
+	raw, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("rabbitmq: opening channel: %w", err)
+	}
+
+	err = raw.Confirm(false)
+	if err != nil {
+		raw.Close()
+		return nil, fmt.Errorf("rabbitmq: enabling publisher confirms: %w", err)
+	}
+
+	// Only one message is in flight on a pooled channel at a time, so there's never
+	// more than one confirmation or return waiting to be read.
+	return &Channel{
+		amqpChannel: raw,
+		confirms:    raw.NotifyPublish(make(chan amqp.Confirmation, 1)),
+		returns:     raw.NotifyReturn(make(chan amqp.Return, 1)),
+	}, nil
+}
+
+// Release returns a channel taken with Channel() to the pool. Channels which the
+// broker has closed, usually because of an error, are dropped, and so are any beyond
+// maxIdleChannels.
+func (c *Connection) Release(ch *Channel) {
+	if ch.IsClosed() {
+		return
+	}
+
+	c.mu.Lock()
+	if c.conn != nil && len(c.channels) < maxIdleChannels {
+		c.channels = append(c.channels, ch)
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+
+	ch.Close()
+}
+
+// The openChannel() method opens a channel which isn't part of the pool, for uses
+// which leave it in a special state, like consuming.
+func (c *Connection) openChannel() (*amqp.Channel, error) {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+
+	if conn == nil {
+		return nil, ErrNotConnected
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("rabbitmq: opening channel: %w", err)
+	}
+
+	return ch, nil
+}
+
+// Close closes the connection and stops reconnecting.
+func (c *Connection) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+
+	conn := c.conn
+	c.conn = nil
+	c.channels = nil
+	c.mu.Unlock()
+
+	c.wg.Wait()
+
+	if conn != nil && !conn.IsClosed() {
+		return conn.Close()
+	}
+
+	return nil
+}
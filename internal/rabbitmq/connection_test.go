@@ -0,0 +1,176 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// fakeChannel stands in for an *amqp.Channel, recording where the last message was
+// published. Its publish function, if set, is called by PublishWithContext() with the
+// pooled Channel, so that it can send a confirmation or return the way the broker
+// would.
+type fakeChannel struct {
+	closed    bool
+	exchange  string
+	key       string
+	mandatory bool
+	ch        *Channel
+	publish   func(ch *Channel, msg amqp.Publishing) error
+}
+
+func (f *fakeChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	f.exchange, f.key, f.mandatory = exchange, key, mandatory
+
+	if f.publish == nil {
+		return nil
+	}
+	return f.publish(f.ch, msg)
+}
+
+func (f *fakeChannel) IsClosed() bool {
+	return f.closed
+}
+
+func (f *fakeChannel) Close() error {
+	f.closed = true
+	return nil
+}
+
+// The newFakeChannel() helper returns a pooled Channel backed by a fakeChannel.
+func newFakeChannel() (*Channel, *fakeChannel) {
+	fake := &fakeChannel{}
+	ch := &Channel{
+		amqpChannel: fake,
+		confirms:    make(chan amqp.Confirmation, 1),
+		returns:     make(chan amqp.Return, 1),
+	}
+	fake.ch = ch
+
+	return ch, fake
+}
+
+// The newTestConnection() helper returns a Connection which looks connected, so that
+// the pool can be used without a broker. Opening a new channel on it would panic, so
+// tests must only take channels they have put in the pool.
+func newTestConnection() *Connection {
+	return &Connection{
+		conn:   &amqp.Connection{},
+		jitter: rand.New(rand.NewSource(1)),
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	c := newTestConnection()
+
+	delay := minReconnectDelay
+	for attempt := 1; attempt <= 20; attempt++ {
+		var shortest, longest time.Duration
+
+		for i := 0; i < 1000; i++ {
+			wait := c.reconnectWait(delay)
+			if wait < delay/2 || wait > delay {
+				t.Fatalf("attempt %d: got wait %v, want between %v and %v", attempt, wait, delay/2, delay)
+			}
+
+			if i == 0 || wait < shortest {
+				shortest = wait
+			}
+			if wait > longest {
+				longest = wait
+			}
+		}
+
+		// The wait is randomized, not stuck at either end of the range.
+		if shortest == longest {
+			t.Errorf("attempt %d: every wait was %v", attempt, shortest)
+		}
+
+		next := nextReconnectDelay(delay)
+		if next < delay || next > maxReconnectDelay || (next != 2*delay && next != maxReconnectDelay) {
+			t.Fatalf("attempt %d: delay went from %v to %v", attempt, delay, next)
+		}
+		delay = next
+	}
+
+	if delay != maxReconnectDelay {
+		t.Errorf("got delay %v after 20 attempts, want it capped at %v", delay, maxReconnectDelay)
+	}
+}
+
+func TestChannelPool(t *testing.T) {
+	c := newTestConnection()
+
+	open, _ := newFakeChannel()
+	closed, closedFake := newFakeChannel()
+
+	c.Release(open)
+	c.Release(closed)
+
+	if len(c.channels) != 2 {
+		t.Fatalf("got %d pooled channels, want 2", len(c.channels))
+	}
+
+	// The broker closes the newest channel while it sits in the pool. Channel() skips
+	// it, and drops it from the pool.
+	closedFake.closed = true
+
+	ch, err := c.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch != open {
+		t.Error("Channel() didn't return the open pooled channel")
+	}
+	if len(c.channels) != 0 {
+		t.Errorf("got %d pooled channels after taking the open one, want 0", len(c.channels))
+	}
+
+	// A channel which is already closed isn't put back.
+	c.Release(closed)
+	if len(c.channels) != 0 {
+		t.Errorf("Release() pooled a closed channel")
+	}
+}
+
+func TestChannelPoolLimit(t *testing.T) {
+	c := newTestConnection()
+
+	fakes := make([]*fakeChannel, maxIdleChannels+2)
+	for i := range fakes {
+		var ch *Channel
+		ch, fakes[i] = newFakeChannel()
+		c.Release(ch)
+	}
+
+	if len(c.channels) != maxIdleChannels {
+		t.Errorf("got %d pooled channels, want %d", len(c.channels), maxIdleChannels)
+	}
+
+	// The channels beyond the limit are closed rather than leaked.
+	for i, fake := range fakes {
+		if want := i >= maxIdleChannels; fake.closed != want {
+			t.Errorf("channel %d: got closed %t, want %t", i, fake.closed, want)
+		}
+	}
+}
+
+func TestChannelNotConnected(t *testing.T) {
+	c := &Connection{}
+
+	_, err := c.Channel()
+	if !errors.Is(err, ErrNotConnected) {
+		t.Errorf("got error %v, want ErrNotConnected", err)
+	}
+
+	// Without a connection there's nothing to pool the channel for.
+	ch, fake := newFakeChannel()
+	c.Release(ch)
+	if len(c.channels) != 0 || !fake.closed {
+		t.Error("Release() pooled a channel while disconnected")
+	}
+}
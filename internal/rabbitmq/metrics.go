@@ -0,0 +1,42 @@
+package rabbitmq
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Metrics counts the messages we publish and consume. A nil *Metrics is valid and
+// counts nothing.
+type Metrics struct {
+	published *prometheus.CounterVec
+	consumed  *prometheus.CounterVec
+}
+
+// NewMetrics creates the RabbitMQ counters. They need registering with a Prometheus
+// registry, using the Collectors() method, before they are exported.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		published: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rabbitmq_messages_published_total",
+			Help: "Messages published to RabbitMQ, by queue and result (success or failure).",
+		}, []string{"queue", "result"}),
+		consumed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rabbitmq_messages_consumed_total",
+			Help: "Messages consumed from RabbitMQ, by queue and outcome (ack, reject, retry, dead_letter or requeue).",
+		}, []string{"queue", "outcome"}),
+	}
+}
+
+// Collectors returns the counters, for registering with a Prometheus registry.
+func (m *Metrics) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.published, m.consumed}
+}
+
+func (m *Metrics) publish(queue, result string) {
+	if m != nil {
+		m.published.WithLabelValues(queue, result).Inc()
+	}
+}
+
+func (m *Metrics) consume(queue, outcome string) {
+	if m != nil {
+		m.consumed.WithLabelValues(queue, outcome).Inc()
+	}
+}
@@ -1,57 +1,188 @@
 package rabbitmq
 
 import (
-	// "bytes"
 	"context"
-	"math/rand"
-
-	// "encoding/gob"
 	"encoding/json"
-
-	// "encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"time"
 
-	// "github.com/JacobNewton007/sendchamp-go-test/internal/data"
+	"github.com/JacobNewton007/sendchamp-go-test/internal/jsonlog"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func failOnError(err error, msg string) {
+// publishTimeout is how long Publish waits for the broker to confirm a message.
+const publishTimeout = 5 * time.Second
+
+// eventsExchange is the topic exchange the task.* events are published to. Services
+// which want them bind their own queues to it.
+const eventsExchange = "task_events"
+
+// ErrNotPublished is wrapped by the errors Publish returns when the broker didn't
+// accept a message: it couldn't be reached, it refused or couldn't route the message,
+// or it didn't confirm it in time. Trying again later may well succeed.
+var ErrNotPublished = errors.New("rabbitmq: message not published")
+
+// Message is a message ready to be published. It's built when the change it describes
+// is made, and written to the outbox in the same transaction, so it only carries
+// plain data which can be stored in the database.
+type Message struct {
+	// ID is sent as the AMQP message ID. The outbox relay sets it to the ID of the
+	// outbox row, so that consumers can recognize a message delivered twice.
+	ID string
+
+	// Topic is the queue to publish to for the "add" topic, and the routing key on
+	// the task_events exchange for everything else.
+	Topic string
+
+	Body    []byte
+	Headers map[string]string
+}
+
+// NewAddTask returns the message which queues a task to be created by the worker. The
+// trace context in ctx is included in the headers, so that processing the task shows
+// up in the same trace as the request which created it.
+func NewAddTask(ctx context.Context, input AddTask) (Message, error) {
+	addTask := AddTask{JobID: input.JobID, Title: input.Title, CreatedBy: input.CreatedBy, OwnerID: input.OwnerID}
+	body, err := json.Marshal(addTask)
 	if err != nil {
-		log.Panicf("%s: %s", msg, err)
+		return Message{}, fmt.Errorf("encoding task: %w", err)
+	}
+
+	headers := map[string]string{}
+	if input.RequestID != "" {
+		headers[requestIDHeader] = input.RequestID
 	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(headers))
+
+	return Message{
+		Topic:   addQueue,
+		Body:    body,
+		Headers: headers,
+	}, nil
 }
 
-func (q RabbitMQ) Publisher(input AddTask) {
-	fmt.Println("Successfully connected to RabbitMq Instance")
-	amqpChannel, err := q.conn.Channel()
-	failOnError(err, "Can't create a amqpChannel")
+// IsAddTask reports whether msg queues a task, as opposed to announcing an event.
+func (msg Message) IsAddTask() bool {
+	return msg.Topic == addQueue
+}
 
-	defer amqpChannel.Close()
+// DecodeAddTask is the reverse of NewAddTask, for handing a task to the worker's
+// handler without going through the broker. The returned context carries the trace
+// context from the message headers.
+func DecodeAddTask(msg Message) (context.Context, AddTask, error) {
+	var addTask AddTask
 
-	queue, err := amqpChannel.QueueDeclare("add", true, false, false, false, nil)
-	failOnError(err, "Could not declare `add` queue")
+	err := json.Unmarshal(msg.Body, &addTask)
+	if err != nil {
+		return context.Background(), AddTask{}, fmt.Errorf("decoding task: %w", err)
+	}
 
-	rand.Seed(time.Now().UnixNano())
+	addTask.RequestID = msg.Headers[requestIDHeader]
 
-	addTask := AddTask{Title: input.Title, CreatedBy: input.CreatedBy}
-	body, err := json.Marshal(addTask)
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(msg.Headers))
+
+	return ctx, addTask, nil
+}
+
+// Publish publishes msg and only returns nil once the broker has confirmed that it
+// took the message, so a message can't be lost without us knowing. Messages for the
+// "add" queue are published as mandatory, so that they're refused rather than dropped
+// if the queue is missing. Events are published to the task_events exchange, where it
+// is fine for nobody to be listening.
+//
+// The span for publishing joins the trace whose context is in the message headers.
+func (q RabbitMQ) Publish(ctx context.Context, msg Message) (err error) {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(msg.Headers))
+
+	ctx, span := startSpan(ctx, msg.Topic, "publish", trace.SpanKindProducer, msg.ID)
+	defer func() {
+		endSpan(span, err)
+
+		if err != nil {
+			q.metrics.publish(msg.Topic, "failure")
+		} else {
+			q.metrics.publish(msg.Topic, "success")
+		}
+	}()
+
+	exchange, mandatory := eventsExchange, false
+	if msg.Topic == addQueue {
+		exchange, mandatory = "", true
+	}
+
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+
+	amqpChannel, err := q.conn.Channel()
 	if err != nil {
-		failOnError(err, "Error encoding JSON")
+		return fmt.Errorf("%w: %v", ErrNotPublished, err)
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	publishCtx, cancel := context.WithTimeout(ctx, publishTimeout)
 	defer cancel()
-	err = amqpChannel.PublishWithContext(ctx, "", queue.Name, false, false, amqp.Publishing{
+
+	err = amqpChannel.publish(publishCtx, exchange, msg.Topic, mandatory, amqp.Publishing{
+		Headers:      headers,
 		DeliveryMode: amqp.Persistent,
-		ContentType:  "text/plain",
-		Body:         body,
+		ContentType:  "application/json",
+		MessageId:    msg.ID,
+		Body:         msg.Body,
 	})
+	if err != nil {
+		// A confirmation for this message could still turn up later and be taken
+		// for the next one published on the channel, so close it instead of
+		// returning it to the pool.
+		amqpChannel.Close()
+		return fmt.Errorf("%w: %v", ErrNotPublished, err)
+	}
 
+	q.conn.Release(amqpChannel)
+
+	q.logger.PrintDebug("published message", jsonlog.Fields{
+		"topic":      msg.Topic,
+		"message_id": msg.ID,
+		"request_id": msg.Headers[requestIDHeader],
+	})
+
+	return nil
+}
+
+// The publish() method publishes msg to exchange with the routing key and waits for
+// the broker to confirm it. If mandatory is set and the message can't be routed to a
+// queue, the broker returns it to us instead of silently dropping it.
+func (ch *Channel) publish(ctx context.Context, exchange, key string, mandatory bool, msg amqp.Publishing) error {
+	err := ch.PublishWithContext(ctx, exchange, key, mandatory, false, msg)
 	if err != nil {
-		log.Fatalf("Error publishing message: %s", err)
+		return err
 	}
 
-	log.Printf("AddTask: %s\n %s", addTask.Title, addTask.CreatedBy)
-	log.Printf(" [x] Sent %+v\n", string(body))
+	select {
+	case confirm, ok := <-ch.confirms:
+		if !ok {
+			return errors.New("channel closed before the message was confirmed")
+		}
+
+		// An unroutable message is still acked, but the broker returns it first, so
+		// by now the return would be waiting for us.
+		select {
+		case ret := <-ch.returns:
+			return fmt.Errorf("message returned by broker: %d %s", ret.ReplyCode, ret.ReplyText)
+		default:
+		}
+
+		if !confirm.Ack {
+			return errors.New("message nacked by broker")
+		}
+
+		return nil
+
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for confirmation: %w", ctx.Err())
+	}
 }
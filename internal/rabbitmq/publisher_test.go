@@ -0,0 +1,183 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JacobNewton007/sendchamp-go-test/internal/jsonlog"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// The ack(), nack() and unroutable() helpers answer a publish the way the broker does.
+func ack(ch *Channel, msg amqp.Publishing) error {
+	ch.confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	return nil
+}
+
+func nack(ch *Channel, msg amqp.Publishing) error {
+	ch.confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: false}
+	return nil
+}
+
+func unroutable(ch *Channel, msg amqp.Publishing) error {
+	ch.returns <- amqp.Return{ReplyCode: amqp.NoRoute, ReplyText: "NO_ROUTE", MessageId: msg.MessageId}
+	return ack(ch, msg)
+}
+
+func TestChannelPublish(t *testing.T) {
+	tests := []struct {
+		name    string
+		publish func(ch *Channel, msg amqp.Publishing) error
+		wantErr string
+	}{
+		{
+			name:    "acked",
+			publish: ack,
+		},
+		{
+			name:    "nacked",
+			publish: nack,
+			wantErr: "message nacked by broker",
+		},
+		{
+			name:    "returned",
+			publish: unroutable,
+			wantErr: "message returned by broker: 312 NO_ROUTE",
+		},
+		{
+			name: "channel closed",
+			publish: func(ch *Channel, msg amqp.Publishing) error {
+				close(ch.confirms)
+				return nil
+			},
+			wantErr: "channel closed before the message was confirmed",
+		},
+		{
+			name: "never confirmed",
+			publish: func(ch *Channel, msg amqp.Publishing) error {
+				return nil
+			},
+			wantErr: "waiting for confirmation: context deadline exceeded",
+		},
+		{
+			name: "publish failed",
+			publish: func(ch *Channel, msg amqp.Publishing) error {
+				return amqp.ErrClosed
+			},
+			wantErr: amqp.ErrClosed.Error(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch, fake := newFakeChannel()
+			fake.publish = tt.publish
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			err := ch.publish(ctx, "", addQueue, true, amqp.Publishing{MessageId: "1"})
+
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("got error %v", err)
+			case tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr):
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPublish(t *testing.T) {
+	tests := []struct {
+		name          string
+		topic         string
+		publish       func(ch *Channel, msg amqp.Publishing) error
+		wantExchange  string
+		wantMandatory bool
+		wantErr       bool
+	}{
+		{
+			name:          "task",
+			topic:         addQueue,
+			publish:       ack,
+			wantExchange:  "",
+			wantMandatory: true,
+		},
+		{
+			name:          "event",
+			topic:         "task.created",
+			publish:       ack,
+			wantExchange:  eventsExchange,
+			wantMandatory: false,
+		},
+		{
+			name:          "nacked",
+			topic:         addQueue,
+			publish:       nack,
+			wantExchange:  "",
+			wantMandatory: true,
+			wantErr:       true,
+		},
+		{
+			name:          "returned",
+			topic:         addQueue,
+			publish:       unroutable,
+			wantExchange:  "",
+			wantMandatory: true,
+			wantErr:       true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestConnection()
+			ch, fake := newFakeChannel()
+			fake.publish = tt.publish
+			c.Release(ch)
+
+			q := NewMq(c, jsonlog.New(io.Discard, jsonlog.LevelOff), nil)
+
+			err := q.Publish(context.Background(), Message{ID: "1", Topic: tt.topic, Body: []byte("{}")})
+
+			if fake.exchange != tt.wantExchange || fake.key != tt.topic || fake.mandatory != tt.wantMandatory {
+				t.Errorf("published to exchange %q with key %q, mandatory %t", fake.exchange, fake.key, fake.mandatory)
+			}
+
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("got error %v", err)
+				}
+
+				// The channel goes back to the pool for the next message.
+				if len(c.channels) != 1 || fake.closed {
+					t.Error("the channel wasn't returned to the pool")
+				}
+				return
+			}
+
+			if !errors.Is(err, ErrNotPublished) || !strings.Contains(err.Error(), "by broker") {
+				t.Errorf("got error %v, want ErrNotPublished with the broker's answer", err)
+			}
+
+			// A late confirmation could be taken for the next message's, so the channel
+			// is closed rather than pooled.
+			if len(c.channels) != 0 || !fake.closed {
+				t.Error("the channel was kept after a failed publish")
+			}
+		})
+	}
+}
+
+func TestPublishNotConnected(t *testing.T) {
+	q := NewMq(&Connection{}, jsonlog.New(io.Discard, jsonlog.LevelOff), nil)
+
+	err := q.Publish(context.Background(), Message{ID: "1", Topic: addQueue})
+	if !errors.Is(err, ErrNotPublished) || !strings.Contains(err.Error(), ErrNotConnected.Error()) {
+		t.Errorf("got error %v, want ErrNotPublished because the connection is down", err)
+	}
+}
@@ -1,20 +1,43 @@
 package rabbitmq
 
 import (
-	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/JacobNewton007/sendchamp-go-test/internal/jsonlog"
 )
 
 type RabbitMQ struct {
-	conn *amqp.Connection
+	conn    *Connection
+	logger  *jsonlog.Logger
+	metrics *Metrics
 }
 
+// AddTask is the message published for every task which is created through the API.
+// RequestID isn't part of the message body; it travels in the x-request-id header so
+// that the worker's logs can be tied back to the HTTP request. FinalAttempt is set by
+// the worker when the task won't be retried again if handling it fails.
 type AddTask struct {
-	Title     string `json:"title"`
-	CreatedBy string `json:"created_by"`
+	JobID        int64  `json:"job_id"`
+	Title        string `json:"title"`
+	CreatedBy    string `json:"created_by"`
+	OwnerID      int64  `json:"owner_id"`
+	RequestID    string `json:"-"`
+	FinalAttempt bool   `json:"-"`
 }
 
-func NewMq(connString *amqp.Connection) RabbitMQ {
+// requestIDHeader is the AMQP message header carrying the ID of the HTTP request which
+// published a message.
+const requestIDHeader = "x-request-id"
+
+// NewMq returns a RabbitMQ using the given connection. The metrics may be nil.
+func NewMq(conn *Connection, logger *jsonlog.Logger, metrics *Metrics) RabbitMQ {
 	return RabbitMQ{
-		conn: connString,
+		conn:    conn,
+		logger:  logger,
+		metrics: metrics,
 	}
 }
+
+// IsClosed reports whether the connection to the broker is down, either because it
+// was closed or because it was lost and hasn't been re-established yet.
+func (q RabbitMQ) IsClosed() bool {
+	return q.conn == nil || !q.conn.IsConnected()
+}
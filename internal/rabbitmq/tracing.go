@@ -0,0 +1,58 @@
+package rabbitmq
+
+import (
+	"context"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/JacobNewton007/sendchamp-go-test/internal/rabbitmq"
+
+// headerCarrier lets the OpenTelemetry propagator read and write the trace context in
+// AMQP message headers, so that the consumer's span joins the publisher's trace.
+type headerCarrier amqp.Table
+
+func (c headerCarrier) Get(key string) string {
+	v, _ := c[key].(string)
+	return v
+}
+
+func (c headerCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// The startSpan() helper starts a span for publishing to or processing a message from
+// queue, with the messaging attributes set.
+func startSpan(ctx context.Context, queue, operation string, kind trace.SpanKind, messageID string) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, queue+" "+operation,
+		trace.WithSpanKind(kind),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "rabbitmq"),
+			attribute.String("messaging.destination", queue),
+			attribute.String("messaging.destination_kind", "queue"),
+			attribute.String("messaging.operation", operation),
+			attribute.String("messaging.message_id", messageID),
+		),
+	)
+}
+
+// The endSpan() helper ends a span, marking it as failed if err isn't nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
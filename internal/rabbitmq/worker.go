@@ -1,90 +1,285 @@
 package rabbitmq
 
 import (
-	// "bytes"
-
-	// "time"
-
-	// "encoding/gob"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
-	// "github.com/JacobNewton007/sendchamp-go-test/internal/data"
-	// "time"
+	"time"
+
+	"github.com/JacobNewton007/sendchamp-go-test/internal/jsonlog"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func (q RabbitMQ) Worker() AddTask {
+// ErrInvalidTask should be wrapped by a task handler when a message can never be
+// processed successfully (for example because it fails validation). Such messages are
+// dropped instead of being requeued.
+var ErrInvalidTask = errors.New("invalid task")
 
-	fmt.Println("Successfully connected to RabbitMq Instance")
+const workerConsumerTag = "task-worker"
 
-	// ch, err := q.conn.Channel()
-	amqpChannel, err := q.conn.Channel()
-	failOnError(err, "Can't create a amqpChannel")
+// Worker consumes AddTask messages from the "add" queue and passes each one to handle
+// until ctx is cancelled. A message is acknowledged once handle returns nil, and
+// rejected without requeueing if it can't be decoded or handle returns an
+// ErrInvalidTask error. For any other error it is retried after retryDelay, and moved
+// to the "add.dead" queue once it has failed maxAttempts times. When ctx is cancelled
+// the worker stops the consumer, lets the in-flight delivery finish and requeues
+// anything the broker has already pushed to us before returning.
+//
+// If the connection to the broker is lost, the worker waits for it to be
+// re-established and starts consuming again. It only returns an error if the
+// connection is closed for good.
+//
+// Each message is handled with a context carrying a span for processing it, which
+// continues the trace the message was published from.
+func (q RabbitMQ) Worker(ctx context.Context, handle func(context.Context, AddTask) error) error {
+	logger := q.logger.With(jsonlog.Fields{"queue": addQueue})
 
-	defer amqpChannel.Close()
+	for {
+		err := q.conn.WaitReady(ctx)
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case err != nil:
+			return err
+		}
+
+		err = q.consume(ctx, logger, handle)
+		if err == nil || ctx.Err() != nil {
+			return nil
+		}
 
-	queue, err := amqpChannel.QueueDeclare("add", true, false, false, false, nil)
-	failOnError(err, "Could not declare `add` queue")
+		logger.PrintWarn("consumer interrupted, restarting", jsonlog.Fields{"error": err})
+
+		// Pause before trying again, so that a channel which keeps failing while the
+		// connection stays up doesn't make us spin.
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// The consume() method runs a single consumer on its own channel. It returns nil once
+// ctx is cancelled and the consumer has been stopped cleanly, or an error if the
+// channel can't be set up or is closed from under it.
+func (q RabbitMQ) consume(ctx context.Context, logger *jsonlog.Logger, handle func(context.Context, AddTask) error) error {
+	// The consumer's channel has its own QoS settings and is closed when we're done,
+	// so it doesn't come from the pool.
+	amqpChannel, err := q.conn.openChannel()
+	if err != nil {
+		return err
+	}
+
+	defer amqpChannel.Close()
 
 	err = amqpChannel.Qos(1, 0, false)
-	failOnError(err, "Could not configure QoS")
+	if err != nil {
+		return fmt.Errorf("could not configure QoS: %w", err)
+	}
 
 	messageChannel, err := amqpChannel.Consume(
-		queue.Name,
-		"",
+		addQueue,
+		workerConsumerTag,
 		false,
 		false,
 		false,
 		false,
 		nil,
 	)
-	failOnError(err, "Could not register consumer")
-
-	// forever := make(chan int)
-	task := make(chan string)
-	var addT AddTask
-	log.Printf(" [x] preparing %+v\n", addT)
-	go func() {
-		// log.Printf("Consumer ready, PID: %d", os.Getpid())
-		for d := range messageChannel {
-			log.Printf("Received a message: %s", d.Body)
-			addTask := &AddTask{}
-
-			err := json.Unmarshal(d.Body, addTask)
-			addT = *addTask
-			task <- "done"
+	if err != nil {
+		return fmt.Errorf("could not register consumer: %w", err)
+	}
+
+	logger.PrintInfo("consumer ready", nil)
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Ask the broker to stop sending us deliveries. Once it has confirmed, the
+			// message channel is closed, so ranging over it requeues anything that was
+			// delivered in the meantime.
+			err := amqpChannel.Cancel(workerConsumerTag, false)
+			if err != nil {
+				return fmt.Errorf("could not cancel consumer: %w", err)
+			}
+
+			for d := range messageChannel {
+				q.metrics.consume(addQueue, "requeue")
+				if err := d.Nack(false, true); err != nil {
+					logger.PrintError(fmt.Errorf("requeueing message: %w", err), nil)
+				}
+			}
+
+			logger.PrintInfo("consumer stopped", nil)
+			return nil
+
+		case d, ok := <-messageChannel:
+			if !ok {
+				return errors.New("rabbitmq delivery channel closed unexpectedly")
+			}
+
+			var addTask AddTask
+
+			err := json.Unmarshal(d.Body, &addTask)
 			if err != nil {
-				log.Printf("Error decoding JSON: %s", err)
+				logger.PrintWarn("dropping undecodable message", jsonlog.Fields{
+					"message_id": d.MessageId,
+					"error":      err,
+				})
+				q.metrics.consume(addQueue, "reject")
+				if err := d.Reject(false); err != nil {
+					logger.PrintError(fmt.Errorf("rejecting message: %w", err), nil)
+				}
+				continue
+			}
+
+			addTask.RequestID, _ = d.Headers[requestIDHeader].(string)
+			addTask.FinalAttempt = attemptsSoFar(d.Headers)+1 >= maxAttempts
+
+			taskLogger := logger.With(jsonlog.Fields{"job_id": addTask.JobID})
+			if addTask.RequestID != "" {
+				taskLogger = taskLogger.With(jsonlog.Fields{"request_id": addTask.RequestID})
 			}
-			log.Printf("AddTask:%s\n %s", addTask.Title, addTask.CreatedBy)
-			if err := d.Ack(false); err != nil {
-				log.Printf("Error acknowledging message : %s", err)
-			} else {
-				log.Printf("Acknowledged message")
+
+			// The handler's context isn't derived from ctx, as cancelling the worker
+			// shouldn't cut short the task it is in the middle of.
+			taskCtx := otel.GetTextMapPropagator().Extract(context.Background(), headerCarrier(d.Headers))
+			taskCtx, span := startSpan(taskCtx, addQueue, "process", trace.SpanKindConsumer, d.MessageId)
+
+			err = handle(taskCtx, addTask)
+			endSpan(span, err)
+
+			switch {
+			case err == nil:
+				q.metrics.consume(addQueue, "ack")
+				if err := d.Ack(false); err != nil {
+					taskLogger.PrintError(fmt.Errorf("acknowledging message: %w", err), nil)
+				}
+			case errors.Is(err, ErrInvalidTask):
+				taskLogger.PrintWarn("dropping task", jsonlog.Fields{"error": err})
+				q.metrics.consume(addQueue, "reject")
+				if err := d.Reject(false); err != nil {
+					taskLogger.PrintError(fmt.Errorf("rejecting message: %w", err), nil)
+				}
+			default:
+				q.retry(ctx, taskLogger, d, err)
 			}
 		}
-		// d := <-messageChannel
-		// log.Printf("Received a message: %s", d.Body)
-
-		// addTask := &AddTask{}
-		// err := json.Unmarshal(d.Body, addTask)
-		// addT = *addTask
-		// if err != nil {
-		// 	log.Printf("Error decoding JSON: %s", err)
-		// }
-		// log.Printf("AddTask:%s\n %s", addT.Title, addT.CreatedBy)
-		// if err := d.Ack(false); err != nil {
-		// 	log.Printf("Error acknowledging message : %s", err)
-		// } else {
-		// 	log.Printf("Acknowledged message")
-		// }
-
-		defer close(task)
-	}()
-	// Stop for program termination
-	// <-forever
-	<-task
-	log.Printf(" [x] Received %+v\n", addT)
-	// return addT
-	return addT
+	}
+}
+
+// The retry() method deals with a delivery which failed with a temporary error. It is
+// published to the retry queue, so that it comes back after retryDelay without holding
+// up the messages behind it, or to the dead-letter queue once it has been tried
+// maxAttempts times. The number of attempts so far travels in the x-attempts header.
+func (q RabbitMQ) retry(ctx context.Context, logger *jsonlog.Logger, d amqp.Delivery, handleErr error) {
+	attempts := attemptsSoFar(d.Headers) + 1
+
+	queue, outcome := retryQueue, "retry"
+	if attempts >= maxAttempts {
+		queue, outcome = deadQueue, "dead_letter"
+	}
+
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[attemptsHeader] = int64(attempts)
+
+	err := q.republish(queue, amqp.Publishing{
+		Headers:      headers,
+		DeliveryMode: amqp.Persistent,
+		ContentType:  d.ContentType,
+		MessageId:    d.MessageId,
+		Body:         d.Body,
+	})
+	if err != nil {
+		// We couldn't park the message, so fall back to requeueing it. Wait first, so
+		// that a task which keeps failing doesn't spin at the head of the queue.
+		logger.PrintWarn("requeueing task", jsonlog.Fields{
+			"error":         handleErr,
+			"publish_error": err,
+			"attempts":      attempts,
+		})
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(retryDelay):
+		}
+
+		q.metrics.consume(addQueue, "requeue")
+		if err := d.Nack(false, true); err != nil {
+			logger.PrintError(fmt.Errorf("requeueing message: %w", err), nil)
+		}
+		return
+	}
+
+	if outcome == "dead_letter" {
+		logger.PrintError(fmt.Errorf("giving up on task after %d attempts: %w", attempts, handleErr), nil)
+	} else {
+		logger.PrintWarn("retrying task later", jsonlog.Fields{
+			"error":    handleErr,
+			"attempts": attempts,
+		})
+	}
+
+	// The message is safely in the other queue, so acknowledge the original.
+	q.metrics.consume(addQueue, outcome)
+	if err := d.Ack(false); err != nil {
+		logger.PrintError(fmt.Errorf("acknowledging message: %w", err), nil)
+	}
+}
+
+// The republish() method publishes msg to queue on a pooled channel and waits for the
+// broker to confirm it.
+func (q RabbitMQ) republish(queue string, msg amqp.Publishing) error {
+	ch, err := q.conn.Channel()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+
+	err = ch.publish(ctx, "", queue, true, msg)
+	if err != nil {
+		ch.Close()
+		return err
+	}
+
+	q.conn.Release(ch)
+
+	return nil
+}
+
+// attemptsHeader counts how many times a task has failed with a temporary error.
+const attemptsHeader = "x-attempts"
+
+// The attemptsSoFar() helper reads the attempts header. AMQP tables can hold any
+// integer type, so accept them all.
+func attemptsSoFar(headers amqp.Table) int {
+	switch v := headers[attemptsHeader].(type) {
+	case int:
+		return v
+	case int8:
+		return int(v)
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case uint8:
+		return int(v)
+	case uint16:
+		return int(v)
+	case uint32:
+		return int(v)
+	default:
+		return 0
+	}
 }
@@ -1,7 +1,8 @@
 CREATE TABLE IF NOT EXISTS tokens (
   id int PRIMARY KEY auto_increment,
   hash BLOB,
-  user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+  user_id int NOT NULL,
   expiry timestamp(0) NOT NULL,
-  scope text NOT NULL
-)
\ No newline at end of file
+  scope text NOT NULL,
+  FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+)
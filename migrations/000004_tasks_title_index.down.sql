@@ -0,0 +1 @@
+DROP INDEX tasks_title_idx ON tasks;
@@ -0,0 +1 @@
+CREATE FULLTEXT INDEX tasks_title_idx ON tasks (title);
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS jobs (
+  id int PRIMARY KEY auto_increment,
+  created_at DATETIME default CURRENT_TIMESTAMP,
+  updated_at DATETIME default CURRENT_TIMESTAMP,
+  user_id int NOT NULL,
+  status varchar(16) NOT NULL DEFAULT 'pending',
+  task_id int NULL,
+  error text NULL,
+  FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
@@ -0,0 +1,2 @@
+ALTER TABLE tasks DROP FOREIGN KEY tasks_owner_fk;
+ALTER TABLE tasks DROP COLUMN owner_id;
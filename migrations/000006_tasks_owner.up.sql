@@ -0,0 +1,28 @@
+ALTER TABLE tasks ADD COLUMN owner_id int NULL;
+
+-- Tasks created before they had owners belong to the user whose email address, or
+-- failing that whose name, matches created_by. Names are only used if no two users
+-- share them.
+UPDATE tasks
+INNER JOIN users ON users.email = tasks.created_by
+SET tasks.owner_id = users.id
+WHERE tasks.owner_id IS NULL;
+
+UPDATE tasks
+INNER JOIN (
+  SELECT MIN(id) AS id, name FROM users GROUP BY name HAVING COUNT(*) = 1
+) AS named ON named.name = tasks.created_by
+SET tasks.owner_id = named.id
+WHERE tasks.owner_id IS NULL;
+
+-- Any other task is given to the first user, usually the administrator, who can hand
+-- it on. Every task was visible to every user before now, so nobody gains access to
+-- anything new. If there are tasks but no users this leaves owner_id NULL and the next
+-- statement fails. In that case create a user, run the rest of this file by hand and
+-- force the version to 6.
+UPDATE tasks
+SET owner_id = (SELECT MIN(id) FROM users)
+WHERE owner_id IS NULL;
+
+ALTER TABLE tasks MODIFY owner_id int NOT NULL;
+ALTER TABLE tasks ADD CONSTRAINT tasks_owner_fk FOREIGN KEY (owner_id) REFERENCES users (id) ON DELETE CASCADE;
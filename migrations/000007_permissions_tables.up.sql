@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS permissions (
+  id int PRIMARY KEY auto_increment,
+  code varchar(255) UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS users_permissions (
+  user_id int NOT NULL,
+  permission_id int NOT NULL,
+  PRIMARY KEY (user_id, permission_id),
+  FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+  FOREIGN KEY (permission_id) REFERENCES permissions (id) ON DELETE CASCADE
+);
+
+INSERT INTO permissions (code)
+VALUES
+  ('tasks:read'),
+  ('tasks:write');
+
+-- Give existing users the permissions they would have been granted at registration and
+-- activation, so that they don't lose access to their tasks.
+INSERT INTO users_permissions (user_id, permission_id)
+SELECT users.id, permissions.id FROM users
+INNER JOIN permissions ON permissions.code = 'tasks:read';
+
+INSERT INTO users_permissions (user_id, permission_id)
+SELECT users.id, permissions.id FROM users
+INNER JOIN permissions ON permissions.code = 'tasks:write'
+WHERE users.activated = 1;
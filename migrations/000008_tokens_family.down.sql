@@ -0,0 +1,2 @@
+DROP INDEX tokens_family_idx ON tokens;
+ALTER TABLE tokens DROP COLUMN family, DROP COLUMN used;
@@ -0,0 +1,2 @@
+ALTER TABLE tokens ADD COLUMN family varbinary(16) NULL, ADD COLUMN used tinyint NOT NULL DEFAULT 0;
+CREATE INDEX tokens_family_idx ON tokens (family);
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS outbox (
+  id bigint PRIMARY KEY auto_increment,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  aggregate_type varchar(32) NOT NULL,
+  aggregate_id bigint NOT NULL,
+  topic varchar(255) NOT NULL,
+  payload blob NOT NULL,
+  headers text NULL,
+  sent_at DATETIME NULL,
+  claimed_until DATETIME NULL
+);
+CREATE INDEX outbox_sent_at_idx ON outbox (sent_at, id);
@@ -0,0 +1,9 @@
+// Package migrations embeds the SQL migration files, so that the cmd/api binary can
+// apply them without the external migrate tool. The MySQL migrations live at the top
+// level, and the other backends have their own directories.
+package migrations
+
+import "embed"
+
+//go:embed *.sql sqlite/*.sql postgres/*.sql
+var FS embed.FS
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS tasks (
+  id bigserial PRIMARY KEY,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  title text NOT NULL,
+  created_by text NOT NULL,
+  owner_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+  version integer NOT NULL DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS tasks_title_idx ON tasks USING GIN (to_tsvector('simple', title));
+CREATE INDEX IF NOT EXISTS tasks_owner_idx ON tasks (owner_id);
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS tokens (
+  hash bytea PRIMARY KEY,
+  user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+  expiry timestamp(0) with time zone NOT NULL,
+  scope text NOT NULL,
+  family bytea NULL,
+  used boolean NOT NULL DEFAULT FALSE
+);
+
+CREATE INDEX IF NOT EXISTS tokens_family_idx ON tokens (family);
@@ -0,0 +1,29 @@
+CREATE TABLE IF NOT EXISTS permissions (
+  id bigserial PRIMARY KEY,
+  code text UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS users_permissions (
+  user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+  permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+  PRIMARY KEY (user_id, permission_id)
+);
+
+INSERT INTO permissions (code)
+VALUES
+  ('tasks:read'),
+  ('tasks:write')
+ON CONFLICT DO NOTHING;
+
+-- Give existing users the permissions they would have been granted at registration and
+-- activation, so that they don't lose access to their tasks.
+INSERT INTO users_permissions (user_id, permission_id)
+SELECT users.id, permissions.id FROM users
+INNER JOIN permissions ON permissions.code = 'tasks:read'
+ON CONFLICT DO NOTHING;
+
+INSERT INTO users_permissions (user_id, permission_id)
+SELECT users.id, permissions.id FROM users
+INNER JOIN permissions ON permissions.code = 'tasks:write'
+WHERE users.activated = 1
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS outbox (
+  id bigserial PRIMARY KEY,
+  created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+  aggregate_type text NOT NULL,
+  aggregate_id bigint NOT NULL,
+  topic text NOT NULL,
+  payload bytea NOT NULL,
+  headers text NULL,
+  sent_at timestamp(0) with time zone NULL,
+  claimed_until timestamp(0) with time zone NULL
+);
+CREATE INDEX IF NOT EXISTS outbox_unsent_idx ON outbox (id) WHERE sent_at IS NULL;
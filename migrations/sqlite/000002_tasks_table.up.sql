@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS tasks (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  title TEXT NOT NULL,
+  created_by TEXT NOT NULL,
+  owner_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  version INTEGER NOT NULL DEFAULT 1
+);
+
+-- tasks_fts is an external content FTS5 index over the task titles, used in place of
+-- MySQL's FULLTEXT index. The triggers keep it in sync with the tasks table.
+CREATE VIRTUAL TABLE IF NOT EXISTS tasks_fts USING fts5(title, content='tasks', content_rowid='id');
+
+CREATE TRIGGER IF NOT EXISTS tasks_fts_insert AFTER INSERT ON tasks BEGIN
+  INSERT INTO tasks_fts (rowid, title) VALUES (new.id, new.title);
+END;
+
+CREATE TRIGGER IF NOT EXISTS tasks_fts_delete AFTER DELETE ON tasks BEGIN
+  INSERT INTO tasks_fts (tasks_fts, rowid, title) VALUES ('delete', old.id, old.title);
+END;
+
+CREATE TRIGGER IF NOT EXISTS tasks_fts_update AFTER UPDATE OF title ON tasks BEGIN
+  INSERT INTO tasks_fts (tasks_fts, rowid, title) VALUES ('delete', old.id, old.title);
+  INSERT INTO tasks_fts (rowid, title) VALUES (new.id, new.title);
+END;
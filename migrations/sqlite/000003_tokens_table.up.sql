@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS tokens (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  hash BLOB NOT NULL,
+  user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  expiry DATETIME NOT NULL,
+  scope TEXT NOT NULL,
+  family BLOB NULL,
+  used INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS tokens_hash_idx ON tokens (hash);
+CREATE INDEX IF NOT EXISTS tokens_family_idx ON tokens (family);
@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS permissions (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  code TEXT UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS users_permissions (
+  user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  permission_id INTEGER NOT NULL REFERENCES permissions (id) ON DELETE CASCADE,
+  PRIMARY KEY (user_id, permission_id)
+);
+
+INSERT INTO permissions (code)
+VALUES
+  ('tasks:read'),
+  ('tasks:write');
+
+-- Give existing users the permissions they would have been granted at registration and
+-- activation, so that they don't lose access to their tasks.
+INSERT INTO users_permissions (user_id, permission_id)
+SELECT users.id, permissions.id FROM users
+INNER JOIN permissions ON permissions.code = 'tasks:read';
+
+INSERT INTO users_permissions (user_id, permission_id)
+SELECT users.id, permissions.id FROM users
+INNER JOIN permissions ON permissions.code = 'tasks:write'
+WHERE users.activated = 1;